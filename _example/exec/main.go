@@ -5,8 +5,7 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
-	"os/signal"
-	"syscall"
+	"time"
 
 	"github.com/mritd/sshutils"
 
@@ -27,10 +26,6 @@ func publicKeyFile(file string) ssh.AuthMethod {
 }
 
 func main() {
-	// monitor os signal
-	sigs := make(chan os.Signal)
-	signal.Notify(sigs, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
-
 	sshConfig := &ssh.ClientConfig{
 		User: "root",
 		Auth: []ssh.AuthMethod{
@@ -48,13 +43,8 @@ func main() {
 		panic(err)
 	}
 	s := sshutils.NewSSHSession(session)
-	go func() {
-		select {
-		case <-sigs:
-			fmt.Println("exit")
-			_ = s.Close()
-		}
-	}()
+	// forward Ctrl-C to the remote command, close the session if it is still running after 3s
+	s.SetSignalForwarding(3 * time.Second)
 
 	// std copy
 	go func() {
@@ -0,0 +1,163 @@
+package sshutils
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"time"
+)
+
+const (
+	extFsync       = "fsync@openssh.com"
+	extPosixRename = "posix-rename@openssh.com"
+	extHardlink    = "hardlink@openssh.com"
+)
+
+// SetAtomic enables atomic remote writes, files are uploaded to a hidden temp
+// file in the same directory and then renamed over the target
+func (s *scpClient) SetAtomic(atomic bool) {
+	s.atomic = atomic
+}
+
+// write r to remote path, if atomic mode is enabled the content is written to
+// a temp file first, mtime is applied in atomic or preserve mode and when not
+// zero, size is only used for progress and may be -1. If backup is true, the
+// existing remote file is kept as backup after the content is written.
+func (s *scpClient) writeRemote(ctx context.Context, r io.Reader, remotePath string, size int64, mode os.FileMode, mtime time.Time, backup bool) error {
+	r, done := s.wrapReader(ctx, r, remotePath, size)
+	defer done()
+
+	if s.atomic || backup {
+		if !s.atomic && !s.preserve {
+			mtime = time.Time{}
+		}
+		return s.atomicWriteRemote(r, remotePath, mode, mtime, backup)
+	}
+
+	// create remote file
+	remoteFile, err := s.sftpClient.Create(remotePath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = remoteFile.Close()
+	}()
+
+	// chmod before the content is written
+	err = remoteFile.Chmod(mode)
+	if err != nil {
+		return err
+	}
+
+	// copy to remote
+	_, err = io.Copy(remoteFile, r)
+	if err != nil {
+		return err
+	}
+
+	if s.preserve && !mtime.IsZero() {
+		return s.sftpClient.Chtimes(remotePath, mtime, mtime)
+	}
+	return nil
+}
+
+// upload to a hidden temp file, fsync, apply mode/times, back up the remote
+// path if backup is true and rename over it
+func (s *scpClient) atomicWriteRemote(r io.Reader, remotePath string, mode os.FileMode, mtime time.Time, backup bool) (err error) {
+	tmpPath := path.Join(path.Dir(remotePath), fmt.Sprintf(".%s.%d.tmp", path.Base(remotePath), time.Now().UnixNano()))
+
+	tmpFile, err := s.sftpClient.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+	if err != nil {
+		return err
+	}
+	// clean temp file on failure
+	defer func() {
+		if err != nil {
+			_ = tmpFile.Close()
+			_ = s.sftpClient.Remove(tmpPath)
+		}
+	}()
+
+	// chmod before the content is written
+	err = tmpFile.Chmod(mode)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(tmpFile, r)
+	if err != nil {
+		return err
+	}
+
+	// flush to stable storage if the server supports it
+	if _, ok := s.sftpClient.HasExtension(extFsync); ok {
+		err = tmpFile.Sync()
+		if err != nil {
+			return err
+		}
+	}
+
+	err = tmpFile.Close()
+	if err != nil {
+		return err
+	}
+
+	if !mtime.IsZero() {
+		err = s.sftpClient.Chtimes(tmpPath, mtime, mtime)
+		if err != nil {
+			return err
+		}
+	}
+
+	if backup {
+		err = s.backupRemote(remotePath)
+		if err != nil {
+			return err
+		}
+	}
+
+	if _, ok := s.sftpClient.HasExtension(extPosixRename); ok {
+		return s.sftpClient.PosixRename(tmpPath, remotePath)
+	}
+
+	// standard sftp rename fails if the target exists, so remove it first;
+	// this leaves a short window where the target is missing
+	_, statErr := s.sftpClient.Stat(remotePath)
+	if statErr == nil {
+		err = s.sftpClient.Remove(remotePath)
+		if err != nil {
+			return err
+		}
+	}
+	return s.sftpClient.Rename(tmpPath, remotePath)
+}
+
+// keep the existing remote file with the backup suffix, it is hard linked if
+// the server supports it so remote path stays in place until it is replaced
+func (s *scpClient) backupRemote(remotePath string) error {
+	_, err := s.sftpClient.Lstat(remotePath)
+	if err != nil {
+		if isNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	// remove the old backup, neither link nor standard rename overwrite it
+	backupPath := s.backupPath(remotePath)
+	_, err = s.sftpClient.Lstat(backupPath)
+	if err == nil {
+		err = s.sftpClient.Remove(backupPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	if _, ok := s.sftpClient.HasExtension(extHardlink); ok {
+		return s.sftpClient.Link(remotePath, backupPath)
+	}
+	// remote path is missing until the temp file is renamed
+	return s.sftpClient.Rename(remotePath, backupPath)
+}
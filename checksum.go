@@ -0,0 +1,386 @@
+package sshutils
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/cespare/xxhash/v2"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// HashAlgorithm is the checksum algorithm used to verify copied files
+type HashAlgorithm string
+
+const (
+	// HashNone disables post-transfer verification
+	HashNone   HashAlgorithm = ""
+	HashSHA256 HashAlgorithm = "sha256"
+	HashMD5    HashAlgorithm = "md5"
+	// HashXXHash is XXH64, the remote side needs the `xxhsum` command
+	HashXXHash HashAlgorithm = "xxhash"
+)
+
+// new local hash for algorithm
+func (a HashAlgorithm) newHash() (hash.Hash, error) {
+	switch a {
+	case HashSHA256:
+		return sha256.New(), nil
+	case HashMD5:
+		return md5.New(), nil
+	case HashXXHash:
+		return xxhash.New(), nil
+	default:
+		return nil, fmt.Errorf("unsupported hash algorithm: %q", string(a))
+	}
+}
+
+// remote command used when the check-file extension is not available
+func (a HashAlgorithm) remoteCmd() string {
+	switch a {
+	case HashSHA256:
+		return "sha256sum"
+	case HashMD5:
+		return "md5sum"
+	case HashXXHash:
+		return "xxhsum -H1"
+	default:
+		return ""
+	}
+}
+
+// algorithm name in the check-file extension, empty if not supported
+func (a HashAlgorithm) checkFileName() string {
+	switch a {
+	case HashSHA256, HashMD5:
+		return string(a)
+	default:
+		return ""
+	}
+}
+
+// ChecksumMismatch describes a copied file whose local and remote checksums differ
+type ChecksumMismatch struct {
+	LocalPath  string
+	RemotePath string
+	LocalSum   string
+	RemoteSum  string
+}
+
+// ChecksumError is returned when post-transfer verification finds mismatched files
+type ChecksumError struct {
+	Algorithm  HashAlgorithm
+	Mismatches []ChecksumMismatch
+}
+
+func (e *ChecksumError) Error() string {
+	var files []string
+	for _, m := range e.Mismatches {
+		files = append(files, fmt.Sprintf("%s -> %s (local %s, remote %s)", m.LocalPath, m.RemotePath, m.LocalSum, m.RemoteSum))
+	}
+	return fmt.Sprintf("%s checksum mismatch: %s", e.Algorithm, strings.Join(files, "; "))
+}
+
+// a local/remote file pair which has been transferred
+type transferPair struct {
+	localPath  string
+	remotePath string
+}
+
+// verify the checksum of transferred files, the check-file sftp extension is
+// preferred and falls back to running the hash command over an exec session
+func (s *scpClient) verify(pairs []transferPair) error {
+	if s.checksum == HashNone || len(pairs) == 0 {
+		return nil
+	}
+
+	var cf *checkFileConn
+	if s.checksum.checkFileName() != "" {
+		var err error
+		cf, err = newCheckFileConn(s.sshClient)
+		if err == nil {
+			defer func() {
+				_ = cf.Close()
+			}()
+		}
+	}
+
+	checksumErr := &ChecksumError{Algorithm: s.checksum}
+	for _, p := range pairs {
+		localSum, err := localChecksum(s.checksum, p.localPath)
+		if err != nil {
+			return err
+		}
+
+		remoteSum, err := s.remoteChecksum(cf, s.checksum, p.remotePath)
+		if err != nil {
+			return err
+		}
+
+		if !strings.EqualFold(localSum, remoteSum) {
+			checksumErr.Mismatches = append(checksumErr.Mismatches, ChecksumMismatch{
+				LocalPath:  p.localPath,
+				RemotePath: p.remotePath,
+				LocalSum:   localSum,
+				RemoteSum:  remoteSum,
+			})
+		}
+	}
+
+	if len(checksumErr.Mismatches) > 0 {
+		s.log().Error("checksum mismatch", "host", s.host(), "algorithm", s.checksum, "files", len(checksumErr.Mismatches))
+		return checksumErr
+	}
+	s.log().Debug("checksum verified", "host", s.host(), "algorithm", s.checksum, "files", len(pairs))
+	return nil
+}
+
+// compute local file checksum
+func localChecksum(algo HashAlgorithm, localPath string) (string, error) {
+	h, err := algo.newHash()
+	if err != nil {
+		return "", err
+	}
+	f, err := os.Open(localPath)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// compute remote file checksum, cf may be nil if check-file is not available
+func (s *scpClient) remoteChecksum(cf *checkFileConn, algo HashAlgorithm, remotePath string) (string, error) {
+	if cf != nil {
+		sum, err := cf.Sum(algo, remotePath)
+		if err == nil {
+			return sum, nil
+		}
+	}
+	return s.execChecksum(algo, remotePath)
+}
+
+// compute remote file checksum by running the hash command
+func (s *scpClient) execChecksum(algo HashAlgorithm, remotePath string) (string, error) {
+	cmd := algo.remoteCmd()
+	if cmd == "" {
+		return "", fmt.Errorf("unsupported hash algorithm: %q", string(algo))
+	}
+	session, err := s.sshClient.NewSession()
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = session.Close()
+	}()
+
+	var stderr bytes.Buffer
+	session.Stderr = &stderr
+	cmd += " -- " + ShellQuote(remotePath)
+	out, err := session.Output(cmd)
+	if err != nil {
+		return "", newRemoteExitError(s.host(), cmd, stderr.String(), err)
+	}
+	fields := strings.Fields(string(out))
+	if len(fields) == 0 {
+		return "", fmt.Errorf("%s: empty output", cmd)
+	}
+	return fields[0], nil
+}
+
+// sftp packet types used by check-file
+const (
+	sshFxpInit          = 1
+	sshFxpVersion       = 2
+	sshFxpStatus        = 101
+	sshFxpExtended      = 200
+	sshFxpExtendedReply = 201
+)
+
+var errCheckFileUnsupported = errors.New("sftp server does not support check-file extension")
+
+// checkFileConn is a minimal sftp connection which only speaks the check-file
+// extension, github.com/pkg/sftp does not expose raw extended requests
+type checkFileConn struct {
+	session *ssh.Session
+	w       io.WriteCloser
+	r       io.Reader
+	id      uint32
+}
+
+// open a new sftp subsystem and check the check-file extension is supported
+func newCheckFileConn(client *ssh.Client) (*checkFileConn, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	c := &checkFileConn{session: session}
+	c.w, err = session.StdinPipe()
+	if err != nil {
+		_ = session.Close()
+		return nil, err
+	}
+	c.r, err = session.StdoutPipe()
+	if err != nil {
+		_ = session.Close()
+		return nil, err
+	}
+	err = session.RequestSubsystem("sftp")
+	if err != nil {
+		_ = session.Close()
+		return nil, err
+	}
+
+	// SSH_FXP_INIT version 3
+	err = c.writePacket(sshFxpInit, appendUint32(nil, 3))
+	if err != nil {
+		_ = c.Close()
+		return nil, err
+	}
+	typ, data, err := c.readPacket()
+	if err != nil {
+		_ = c.Close()
+		return nil, err
+	}
+	if typ != sshFxpVersion || len(data) < 4 {
+		_ = c.Close()
+		return nil, fmt.Errorf("unexpected sftp packet type %d", typ)
+	}
+
+	// extension pairs follow the version
+	data = data[4:]
+	for len(data) > 0 {
+		var name string
+		name, data, err = readString(data)
+		if err != nil {
+			break
+		}
+		_, data, err = readString(data)
+		if err != nil {
+			break
+		}
+		if name == "check-file" {
+			return c, nil
+		}
+	}
+	_ = c.Close()
+	return nil, errCheckFileUnsupported
+}
+
+// Sum returns the hex checksum of the whole remote file
+func (c *checkFileConn) Sum(algo HashAlgorithm, remotePath string) (string, error) {
+	name := algo.checkFileName()
+	if name == "" {
+		return "", errCheckFileUnsupported
+	}
+
+	c.id++
+	var b []byte
+	b = appendUint32(b, c.id)
+	b = appendString(b, "check-file-name")
+	b = appendString(b, remotePath)
+	b = appendString(b, name)
+	// start offset, length (0 means the whole file) and block size (0 means one hash)
+	b = appendUint64(b, 0)
+	b = appendUint64(b, 0)
+	b = appendUint32(b, 0)
+	err := c.writePacket(sshFxpExtended, b)
+	if err != nil {
+		return "", err
+	}
+
+	typ, data, err := c.readPacket()
+	if err != nil {
+		return "", err
+	}
+	switch typ {
+	case sshFxpExtendedReply:
+		if len(data) < 4 {
+			return "", errors.New("short check-file reply")
+		}
+		used, sum, err := readString(data[4:])
+		if err != nil {
+			return "", err
+		}
+		if used != name {
+			return "", fmt.Errorf("check-file replied with %s, want %s", used, name)
+		}
+		return hex.EncodeToString(sum), nil
+	case sshFxpStatus:
+		return "", fmt.Errorf("check-file %s failed", remotePath)
+	default:
+		return "", fmt.Errorf("unexpected sftp packet type %d", typ)
+	}
+}
+
+// close the sftp subsystem session
+func (c *checkFileConn) Close() error {
+	_ = c.w.Close()
+	return c.session.Close()
+}
+
+func (c *checkFileConn) writePacket(typ byte, payload []byte) error {
+	b := appendUint32(nil, uint32(len(payload)+1))
+	b = append(b, typ)
+	b = append(b, payload...)
+	_, err := c.w.Write(b)
+	return err
+}
+
+func (c *checkFileConn) readPacket() (byte, []byte, error) {
+	var l [4]byte
+	_, err := io.ReadFull(c.r, l[:])
+	if err != nil {
+		return 0, nil, err
+	}
+	n := binary.BigEndian.Uint32(l[:])
+	if n == 0 || n > 256*1024 {
+		return 0, nil, fmt.Errorf("invalid sftp packet length %d", n)
+	}
+	b := make([]byte, n)
+	_, err = io.ReadFull(c.r, b)
+	if err != nil {
+		return 0, nil, err
+	}
+	return b[0], b[1:], nil
+}
+
+func appendString(b []byte, s string) []byte {
+	b = appendUint32(b, uint32(len(s)))
+	return append(b, s...)
+}
+
+func readString(b []byte) (string, []byte, error) {
+	if len(b) < 4 {
+		return "", nil, errors.New("short sftp string")
+	}
+	n := binary.BigEndian.Uint32(b)
+	b = b[4:]
+	if uint32(len(b)) < n {
+		return "", nil, errors.New("short sftp string")
+	}
+	return string(b[:n]), b[n:], nil
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	return appendUint32(appendUint32(b, uint32(v>>32)), uint32(v))
+}
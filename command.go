@@ -0,0 +1,447 @@
+package sshutils
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// markers printed by the remote side to detect the password prompt and
+// the start of the command after switching user
+const (
+	passwordMarker = "[sshutils-password]"
+	startMarker    = "[sshutils-start]"
+)
+
+var (
+	// characters which do not need quoting
+	shellSafeRe = regexp.MustCompile(`^[A-Za-z0-9_@%+=:,./-]+$`)
+	// valid environment variable name
+	envNameRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+)
+
+// ShellQuote quotes s for POSIX shell, s is returned as is if it contains
+// only safe characters
+func ShellQuote(s string) string {
+	if shellSafeRe.MatchString(s) {
+		return s
+	}
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// ShellJoin quotes args and joins them with spaces
+func ShellJoin(args ...string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = ShellQuote(arg)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// Command is a remote command with environment variables, working directory
+// and user to run as
+type Command struct {
+	client *ssh.Client
+	// command and arguments, quoted when the command line is built
+	args []string
+	// shell script, used as is if args is empty
+	script string
+	// environment variables in order
+	env [][2]string
+	// working directory
+	dir string
+	// user to run as, empty for the login user
+	user string
+	// use `su` instead of `sudo` to switch user
+	useSu bool
+	// sudo password of the login user or su password of the target user
+	password string
+	// structured event logger, default is NopLogger
+	logger Logger
+	// the Conn which tracks the session, nil if not created by Conn
+	conn   *Conn
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// NewCommand creates a command, name and args are quoted
+func NewCommand(client *ssh.Client, name string, args ...string) *Command {
+	return &Command{
+		client: client,
+		args:   append([]string{name}, args...),
+	}
+}
+
+// NewShellCommand creates a command from a shell script, the script is not quoted
+func NewShellCommand(client *ssh.Client, script string) *Command {
+	return &Command{
+		client: client,
+		script: script,
+	}
+}
+
+// set an environment variable, it is sent by Setenv and falls back to an
+// `env` prefix if the server rejects it
+func (c *Command) SetEnv(key, value string) {
+	for i := range c.env {
+		if c.env[i][0] == key {
+			c.env[i][1] = value
+			return
+		}
+	}
+	c.env = append(c.env, [2]string{key, value})
+}
+
+// set the working directory
+func (c *Command) SetDir(dir string) {
+	c.dir = dir
+}
+
+// run as user by `sudo -u`, password is the sudo password of the login
+// user, empty password means sudo must not ask for one
+func (c *Command) SetSudo(user, password string) {
+	c.user = user
+	c.useSu = false
+	c.password = password
+}
+
+// run as user by `su`, password is the password of the target user
+func (c *Command) SetSu(user, password string) {
+	c.user = user
+	c.useSu = true
+	c.password = password
+}
+
+// set the event logger, nil disables logging
+func (c *Command) SetLogger(logger Logger) {
+	c.logger = logger
+}
+
+func (c *Command) log() Logger {
+	return loggerOrNop(c.logger)
+}
+
+// String returns the command line, all environment variables are set by
+// the `env` prefix
+func (c *Command) String() string {
+	return c.commandLine(c.env)
+}
+
+// build the command line, env is set by the `env` prefix
+func (c *Command) commandLine(env [][2]string) string {
+	body := c.script
+	if len(c.args) > 0 {
+		body = ShellJoin(c.args...)
+	}
+
+	if len(env) > 0 {
+		prefix := "env"
+		for _, kv := range env {
+			prefix += " " + ShellQuote(kv[0]+"="+kv[1])
+		}
+		if len(c.args) > 0 {
+			body = prefix + " " + body
+		} else {
+			body = prefix + " sh -c " + ShellQuote(body)
+		}
+	}
+
+	if c.dir != "" {
+		body = "cd " + ShellQuote(c.dir) + " && " + body
+	}
+
+	if c.user == "" {
+		return body
+	}
+
+	// print the start marker after switching user, so the password prompt
+	// handling knows stdin belongs to the command from now on
+	if c.useSu {
+		if c.password != "" {
+			body = "printf %s " + ShellQuote(startMarker) + " && " + body
+		}
+		return "su - " + ShellQuote(c.user) + " -c " + ShellQuote(body)
+	}
+	if c.password == "" {
+		return "sudo -n -u " + ShellQuote(c.user) + " -- sh -c " + ShellQuote(body)
+	}
+	body = "printf %s " + ShellQuote(startMarker) + " >&2 && " + body
+	return "sudo -S -p " + ShellQuote(passwordMarker) + " -u " + ShellQuote(c.user) + " -- sh -c " + ShellQuote(body)
+}
+
+// Run runs the command and waits for it to exit, it returns
+// *RemoteExitError if the command failed
+func (c *Command) Run() error {
+	return c.run(c.Stdout, c.Stderr)
+}
+
+// Output runs the command and returns its stdout, stderr is included in
+// *RemoteExitError if the command failed
+func (c *Command) Output() ([]byte, error) {
+	stdout, _, err := c.output()
+	return stdout, err
+}
+
+// run the command and capture stdout and stderr
+func (c *Command) output() ([]byte, string, error) {
+	var stdout, stderr bytes.Buffer
+	errW := io.Writer(&stderr)
+	if c.Stderr != nil {
+		errW = io.MultiWriter(&stderr, c.Stderr)
+	}
+	err := c.run(&stdout, errW)
+	if exitErr, ok := err.(*RemoteExitError); ok {
+		exitErr.Stderr = strings.TrimSpace(stderr.String())
+	}
+	return stdout.Bytes(), strings.TrimSpace(stderr.String()), err
+}
+
+func (c *Command) run(stdout, stderr io.Writer) error {
+	for _, kv := range c.env {
+		if !envNameRe.MatchString(kv[0]) {
+			return fmt.Errorf("invalid environment variable name %q: %w", kv[0], ErrInvalidParameter)
+		}
+	}
+
+	if c.conn != nil && c.conn.isClosed() {
+		return ErrConnClosed
+	}
+	session, err := c.client.NewSession()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = session.Close()
+	}()
+	if c.conn != nil {
+		tracked, err := c.conn.track("exec", c.String(), session.Close)
+		if err != nil {
+			return err
+		}
+		defer c.conn.untrack(tracked)
+		c.conn.update(tracked, "", "", SessionRunning, nil)
+	}
+
+	// the environment is reset when switching user, so use the `env` prefix
+	var envPrefix [][2]string
+	if c.user != "" {
+		envPrefix = c.env
+	} else {
+		for _, kv := range c.env {
+			err = session.Setenv(kv[0], kv[1])
+			if err != nil {
+				c.log().Debug("setenv rejected, fallback to env prefix", "name", kv[0], "error", err)
+				envPrefix = append(envPrefix, kv)
+			}
+		}
+	}
+	cmd := c.commandLine(envPrefix)
+
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		return err
+	}
+
+	// the password is fed when the prompt shows up, stdin is forwarded
+	// when the command started
+	startCh := make(chan struct{})
+	var startOnce sync.Once
+	started := func() { startOnce.Do(func() { close(startCh) }) }
+	prompts := 0
+	prompted := func() {
+		prompts++
+		c.log().Debug("password prompt", "user", c.user, "count", prompts)
+		if prompts > 1 {
+			// the password is wrong, close stdin to fail the prompt
+			_ = stdin.Close()
+			return
+		}
+		_, err := io.WriteString(stdin, c.password+"\n")
+		if err != nil {
+			c.log().Warn("write password failed", "error", err)
+		}
+	}
+
+	// VEOF character of the pty, 0 without a pty
+	var veof byte
+	var marker *markerWriter
+	session.Stdout = stdout
+	session.Stderr = stderr
+	switch {
+	case c.user == "" || c.password == "":
+		started()
+	case c.useSu:
+		// su reads the password from the terminal
+		veof = 4
+		// no output processing, so the output is not changed to CRLF
+		modes := ssh.TerminalModes{ssh.ECHO: 0, ssh.VEOF: uint32(veof), ssh.OPOST: 0, ssh.ONLCR: 0}
+		err = session.RequestPty("dumb", 24, 80, modes)
+		if err != nil {
+			return err
+		}
+		// the prompt and the messages of su are not output of the command
+		marker = &markerWriter{w: stdout, onPrompt: prompted, onStart: started, prompt: []byte("assword:"), hold: true, heldW: stderr}
+		session.Stdout = marker
+	default:
+		marker = &markerWriter{w: stderr, onPrompt: prompted, onStart: started, prompt: []byte(passwordMarker)}
+		session.Stderr = marker
+	}
+
+	err = session.Start(cmd)
+	if err != nil {
+		return err
+	}
+	c.log().Info("command started", "cmd", cmd)
+
+	go func() {
+		<-startCh
+		w := &lastByteWriter{w: stdin}
+		if c.Stdin != nil {
+			_, err := io.Copy(w, c.Stdin)
+			if err != nil {
+				c.log().Warn("copy stdin failed", "error", err)
+			}
+		}
+		// a pty ignores closing the write side, VEOF sends a pending line
+		// and the second one on an empty line is EOF
+		if veof != 0 {
+			eof := []byte{veof}
+			if w.n > 0 && w.last != '\n' {
+				eof = append(eof, veof)
+			}
+			_, err := stdin.Write(eof)
+			if err != nil {
+				c.log().Debug("write stdin eof failed", "error", err)
+			}
+		}
+		_ = stdin.Close()
+	}()
+
+	waitErr := session.Wait()
+	if marker != nil {
+		if err = marker.flush(); err != nil {
+			c.log().Warn("write output failed", "error", err)
+		}
+	}
+	err = newRemoteExitError(c.client.RemoteAddr().String(), cmd, "", waitErr)
+	started()
+	c.log().Info("command finished", "cmd", cmd, "error", err)
+	return err
+}
+
+// markerWriter strips password prompt and start marker from the output,
+// output after the start marker is passed through
+type markerWriter struct {
+	w        io.Writer
+	prompt   []byte
+	onPrompt func()
+	onStart  func()
+	pending  []byte
+	done     bool
+	// hold the output before the start marker instead of passing it to w,
+	// it is dropped when the command starts and written to heldW by flush
+	// if the command never started, e.g. the error of su
+	hold  bool
+	held  []byte
+	heldW io.Writer
+}
+
+func (m *markerWriter) Write(p []byte) (int, error) {
+	if m.done {
+		return m.write(p)
+	}
+
+	m.pending = append(m.pending, p...)
+	for {
+		// output after the start marker belongs to the command
+		start := bytes.Index(m.pending, []byte(startMarker))
+		if i := bytes.Index(m.pending, m.prompt); i >= 0 && (start < 0 || i < start) {
+			m.onPrompt()
+			if m.hold {
+				// the output before the prompt is the prompt itself
+				m.held = nil
+				m.pending = append([]byte(nil), m.pending[i+len(m.prompt):]...)
+			} else {
+				m.pending = append(m.pending[:i], m.pending[i+len(m.prompt):]...)
+			}
+			continue
+		}
+		if start >= 0 {
+			m.onStart()
+			m.done = true
+			out := m.pending[start+len(startMarker):]
+			if m.hold {
+				m.held = nil
+			} else {
+				out = append(m.pending[:start], out...)
+			}
+			m.pending = nil
+			if _, err := m.write(out); err != nil {
+				return 0, err
+			}
+			return len(p), nil
+		}
+		break
+	}
+
+	// keep the tail which may be the beginning of a marker
+	keep := markerPrefixLen(m.pending, m.prompt)
+	if n := markerPrefixLen(m.pending, []byte(startMarker)); n > keep {
+		keep = n
+	}
+	out := m.pending[:len(m.pending)-keep]
+	m.pending = append([]byte(nil), m.pending[len(m.pending)-keep:]...)
+	if m.hold {
+		m.held = append(m.held, out...)
+		return len(p), nil
+	}
+	if _, err := m.write(out); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// write the output kept back for a possible marker, it must be called
+// when the output ended
+func (m *markerWriter) flush() error {
+	pending := m.pending
+	m.pending = nil
+	if !m.hold || m.done {
+		_, err := m.write(pending)
+		return err
+	}
+	held := append(m.held, pending...)
+	m.held = nil
+	if m.heldW == nil || len(held) == 0 {
+		return nil
+	}
+	_, err := m.heldW.Write(held)
+	return err
+}
+
+func (m *markerWriter) write(p []byte) (int, error) {
+	if m.w == nil || len(p) == 0 {
+		return len(p), nil
+	}
+	return m.w.Write(p)
+}
+
+// length of the longest suffix of b which is a prefix of marker
+func markerPrefixLen(b, marker []byte) int {
+	n := len(marker) - 1
+	if n > len(b) {
+		n = len(b)
+	}
+	for ; n > 0; n-- {
+		if bytes.HasPrefix(marker, b[len(b)-n:]) {
+			return n
+		}
+	}
+	return 0
+}
@@ -0,0 +1,202 @@
+package sshutils
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestShellQuote(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"abc", "abc"},
+		{"/usr/bin/env", "/usr/bin/env"},
+		{"--opt=a,b:c@d%e+f", "--opt=a,b:c@d%e+f"},
+		{"", "''"},
+		{"a b", "'a b'"},
+		{"it's", `'it'\''s'`},
+		{"$HOME", "'$HOME'"},
+		{startMarker, "'" + startMarker + "'"},
+	}
+	for _, tt := range tests {
+		if got := ShellQuote(tt.in); got != tt.want {
+			t.Errorf("ShellQuote(%q) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+	if got := ShellJoin("a", "", "b c"); got != "a '' 'b c'" {
+		t.Errorf("ShellJoin = %s", got)
+	}
+}
+
+// the quoted strings must reach the command unchanged, also when the
+// working directory has files matching them as glob patterns
+func TestShellQuoteShell(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh not found")
+	}
+	dir, err := ioutil.TempDir("", "sshutils-quote-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	for _, name := range []string{"a", "s", "t", "x y"} {
+		if err = ioutil.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, s := range []string{startMarker, passwordMarker, "*", "?", "[a-z]", "it's", "a  b", "$HOME `id` $(id)", "\\", "\n", "~"} {
+		cmd := exec.Command("sh", "-c", "printf %s "+ShellQuote(s))
+		cmd.Dir = dir
+		out, err := cmd.Output()
+		if err != nil {
+			t.Fatalf("%q: %v", s, err)
+		}
+		if string(out) != s {
+			t.Errorf("%q: printed %q", s, out)
+		}
+	}
+}
+
+func TestCommandLine(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(c *Command)
+		want  string
+	}{
+		{name: "plain", setup: func(c *Command) {}, want: "echo 'a b'"},
+		{name: "dir", setup: func(c *Command) { c.SetDir("/tmp/x y") }, want: "cd '/tmp/x y' && echo 'a b'"},
+		{name: "sudo", setup: func(c *Command) { c.SetSudo("root", "") }, want: `sudo -n -u root -- sh -c 'echo '\''a b'\'''`},
+		{
+			name:  "sudo password",
+			setup: func(c *Command) { c.SetSudo("root", "pw") },
+			want:  `sudo -S -p '[sshutils-password]' -u root -- sh -c 'printf %s '\''[sshutils-start]'\'' >&2 && echo '\''a b'\'''`,
+		},
+		{
+			name:  "su password",
+			setup: func(c *Command) { c.SetSu("root", "pw") },
+			want:  `su - root -c 'printf %s '\''[sshutils-start]'\'' && echo '\''a b'\'''`,
+		},
+	}
+	for _, tt := range tests {
+		c := NewCommand(nil, "echo", "a b")
+		tt.setup(c)
+		if got := c.String(); got != tt.want {
+			t.Errorf("%s: got\n%s\nwant\n%s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestMarkerWriter(t *testing.T) {
+	tests := []struct {
+		name        string
+		prompt      string
+		hold        bool
+		data        string
+		want        string
+		wantHeld    string
+		wantPrompts int
+		wantStart   bool
+	}{
+		{
+			name:        "sudo",
+			prompt:      passwordMarker,
+			data:        "warning\n" + passwordMarker + startMarker + "err\n",
+			want:        "warning\nerr\n",
+			wantPrompts: 1,
+			wantStart:   true,
+		},
+		{
+			name:        "su",
+			prompt:      "assword:",
+			hold:        true,
+			data:        "Password: \r\n" + startMarker + "{\"a\":1}\n",
+			want:        "{\"a\":1}\n",
+			wantPrompts: 1,
+			wantStart:   true,
+		},
+		{
+			name:        "su output like markers",
+			prompt:      "assword:",
+			hold:        true,
+			data:        "Password: " + startMarker + "out [sshutils-start] assword:\n",
+			want:        "out [sshutils-start] assword:\n",
+			wantPrompts: 1,
+			wantStart:   true,
+		},
+		{
+			name:        "su failed",
+			prompt:      "assword:",
+			hold:        true,
+			data:        "Password: \r\nsu: Authentication failure\r\n",
+			wantHeld:    " \r\nsu: Authentication failure\r\n",
+			wantPrompts: 1,
+		},
+		{
+			name:        "wrong password",
+			prompt:      passwordMarker,
+			data:        passwordMarker + "Sorry, try again.\n" + passwordMarker + "failed\n",
+			want:        "Sorry, try again.\nfailed\n",
+			wantPrompts: 2,
+		},
+		{name: "no password", prompt: passwordMarker, data: startMarker + "[sshutils", want: "[sshutils", wantStart: true},
+		{name: "marker prefix at end", prompt: passwordMarker, data: "a[sshutils-x]b[", want: "a[sshutils-x]b["},
+	}
+	for _, tt := range tests {
+		// write in two parts split at every position, so markers are split
+		// across writes
+		for split := 0; split <= len(tt.data); split++ {
+			var out, held bytes.Buffer
+			prompts, started := 0, false
+			m := &markerWriter{
+				w:        &out,
+				prompt:   []byte(tt.prompt),
+				onPrompt: func() { prompts++ },
+				onStart:  func() { started = true },
+				hold:     tt.hold,
+				heldW:    &held,
+			}
+			for _, part := range []string{tt.data[:split], tt.data[split:]} {
+				n, err := m.Write([]byte(part))
+				if err != nil || n != len(part) {
+					t.Fatalf("%s: write = %d, %v", tt.name, n, err)
+				}
+			}
+			if err := m.flush(); err != nil {
+				t.Fatal(err)
+			}
+			if out.String() != tt.want || held.String() != tt.wantHeld || prompts != tt.wantPrompts || started != tt.wantStart {
+				t.Fatalf("%s (split %d): output %q, held %q, prompts %d, started %v; want %q, %q, %d, %v",
+					tt.name, split, out.String(), held.String(), prompts, started, tt.want, tt.wantHeld, tt.wantPrompts, tt.wantStart)
+			}
+		}
+	}
+}
+
+func TestMarkerPrefixLen(t *testing.T) {
+	marker := []byte(startMarker)
+	tests := []struct {
+		b    string
+		want int
+	}{
+		{"", 0},
+		{"abc", 0},
+		{"abc[", 1},
+		{"abc[sshutils-", len("[sshutils-")},
+		{"[sshutils-start", len(startMarker) - 1},
+		{"[sshutils-start]", 0},
+		{"[[", 1},
+	}
+	for _, tt := range tests {
+		if got := markerPrefixLen([]byte(tt.b), marker); got != tt.want {
+			t.Errorf("markerPrefixLen(%q) = %d, want %d", tt.b, got, tt.want)
+		}
+	}
+}
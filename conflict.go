@@ -0,0 +1,181 @@
+package sshutils
+
+import (
+	"os"
+	"strings"
+)
+
+// ConflictPolicy decides what happens when a copy destination already exists
+type ConflictPolicy int
+
+const (
+	// ConflictOverwrite replaces the existing destination file
+	ConflictOverwrite ConflictPolicy = iota
+	// ConflictSkip keeps the existing destination file
+	ConflictSkip
+	// ConflictError aborts the copy, an existing destination directory is an error too
+	ConflictError
+	// ConflictOverwriteIfNewer replaces the destination only if the source mtime is newer
+	ConflictOverwriteIfNewer
+	// ConflictOverwriteIfDifferent replaces the destination only if size or content differs
+	ConflictOverwriteIfDifferent
+	// ConflictBackup keeps the existing destination with the backup suffix, a
+	// remote destination is backed up after the new content is written
+	ConflictBackup
+)
+
+const defaultBackupSuffix = "~"
+
+// SetConflictPolicy sets the policy for existing destinations, default is ConflictOverwrite
+func (s *scpClient) SetConflictPolicy(policy ConflictPolicy) {
+	s.conflictPolicy = policy
+}
+
+// SetBackupSuffix sets the suffix used by ConflictBackup, default is "~"
+func (s *scpClient) SetBackupSuffix(suffix string) {
+	s.backupSuffix = suffix
+}
+
+func (s *scpClient) backupPath(p string) string {
+	if s.backupSuffix == "" {
+		return p + defaultBackupSuffix
+	}
+	return p + s.backupSuffix
+}
+
+// algorithm used by ConflictOverwriteIfDifferent
+func (s *scpClient) compareAlgorithm() HashAlgorithm {
+	if s.checksum == HashNone {
+		return HashSHA256
+	}
+	return s.checksum
+}
+
+// remote checksum used by ConflictOverwriteIfDifferent, like verify the
+// check-file extension is preferred over running the hash command
+func (s *scpClient) compareChecksum(algo HashAlgorithm, remotePath string) (string, error) {
+	var cf *checkFileConn
+	if algo.checkFileName() != "" {
+		var err error
+		cf, err = newCheckFileConn(s.sshClient)
+		if err == nil {
+			defer func() {
+				_ = cf.Close()
+			}()
+		}
+	}
+	return s.remoteChecksum(cf, algo, remotePath)
+}
+
+// check an existing destination directory, returns error if the policy
+// does not allow merging into it, remote is true if dstPath is a remote path
+func (s *scpClient) checkDirConflict(dstPath string, dstInfo os.FileInfo, remote bool) error {
+	var err error
+	if !dstInfo.IsDir() {
+		err = ErrNotDir
+	} else if s.conflictPolicy == ConflictError {
+		err = ErrExist
+	}
+	if err == nil {
+		return nil
+	}
+	if remote {
+		return s.pathError("copy", dstPath, err)
+	}
+	return &PathError{Op: "copy", Path: dstPath, Err: err}
+}
+
+// resolve conflict with remote path before uploading local file, returns
+// false if the file should not be copied
+func (s *scpClient) resolveRemoteConflict(localPath string, localInfo os.FileInfo, remotePath string) (bool, error) {
+	remoteInfo, err := s.sftpClient.Stat(remotePath)
+	if err != nil {
+		// remote file not exist
+		if isNotExist(err) {
+			return true, nil
+		}
+		return false, s.pathError("stat", remotePath, err)
+	}
+	if remoteInfo.IsDir() {
+		return false, s.pathError("copy", remotePath, ErrIsDir)
+	}
+
+	switch s.conflictPolicy {
+	case ConflictSkip:
+		return false, nil
+	case ConflictError:
+		return false, s.pathError("copy", remotePath, ErrExist)
+	case ConflictOverwriteIfNewer:
+		return localInfo.ModTime().After(remoteInfo.ModTime()), nil
+	case ConflictOverwriteIfDifferent:
+		if localInfo.Size() != remoteInfo.Size() {
+			return true, nil
+		}
+		algo := s.compareAlgorithm()
+		localSum, err := localChecksum(algo, localPath)
+		if err != nil {
+			return false, err
+		}
+		remoteSum, err := s.compareChecksum(algo, remotePath)
+		if err != nil {
+			return false, err
+		}
+		return !strings.EqualFold(localSum, remoteSum), nil
+	case ConflictBackup:
+		// writeRemote backs it up after the upload
+		return true, nil
+	default:
+		// remove remote file, atomic mode renames over it instead
+		if !s.atomic {
+			err = s.sftpClient.Remove(remotePath)
+			if err != nil {
+				return false, err
+			}
+		}
+		return true, nil
+	}
+}
+
+// resolve conflict with local path before downloading remote file, returns
+// false if the file should not be copied
+func (s *scpClient) resolveLocalConflict(remotePath string, remoteInfo os.FileInfo, localPath string) (bool, error) {
+	localInfo, err := os.Stat(localPath)
+	if err != nil {
+		// local file not exist
+		if isNotExist(err) {
+			return true, nil
+		}
+		return false, err
+	}
+	if localInfo.IsDir() {
+		return false, &PathError{Op: "copy", Path: localPath, Err: ErrIsDir}
+	}
+
+	switch s.conflictPolicy {
+	case ConflictSkip:
+		return false, nil
+	case ConflictError:
+		return false, &PathError{Op: "copy", Path: localPath, Err: ErrExist}
+	case ConflictOverwriteIfNewer:
+		return remoteInfo.ModTime().After(localInfo.ModTime()), nil
+	case ConflictOverwriteIfDifferent:
+		if localInfo.Size() != remoteInfo.Size() {
+			return true, nil
+		}
+		algo := s.compareAlgorithm()
+		localSum, err := localChecksum(algo, localPath)
+		if err != nil {
+			return false, err
+		}
+		remoteSum, err := s.compareChecksum(algo, remotePath)
+		if err != nil {
+			return false, err
+		}
+		return !strings.EqualFold(localSum, remoteSum), nil
+	case ConflictBackup:
+		return true, os.Rename(localPath, s.backupPath(localPath))
+	default:
+		// remove local file
+		return true, os.Remove(localPath)
+	}
+}
@@ -0,0 +1,244 @@
+package sshutils
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ErrConnClosed means the connection was closed
+var ErrConnClosed = errors.New("connection closed")
+
+// SessionState is the state of a session opened by Conn
+type SessionState int
+
+const (
+	// SessionIdle means the session is open and runs nothing
+	SessionIdle SessionState = iota
+	// SessionRunning means the session runs a terminal, command or sftp
+	SessionRunning
+	// SessionExited means the terminal or command exited, the session is not closed yet
+	SessionExited
+)
+
+func (s SessionState) String() string {
+	switch s {
+	case SessionIdle:
+		return "idle"
+	case SessionRunning:
+		return "running"
+	case SessionExited:
+		return "exited"
+	default:
+		return "unknown"
+	}
+}
+
+// SessionInfo describes a session opened by Conn
+type SessionInfo struct {
+	ID int
+	// "terminal", "exec" or "sftp", empty if the session runs nothing yet
+	Kind string
+	// the command of exec sessions
+	Cmd     string
+	State   SessionState
+	Started time.Time
+	// the error of exited sessions
+	Err error
+}
+
+// session tracked by Conn
+type trackedSession struct {
+	info    SessionInfo
+	closeFn func() error
+}
+
+// Conn is a connection which opens many sessions concurrently, tracks
+// them and closes them all together, like OpenSSH ControlMaster
+type Conn struct {
+	client *ssh.Client
+	logger Logger
+
+	mu       sync.Mutex
+	nextID   int
+	sessions map[int]*trackedSession
+	closed   bool
+	doneCh   chan struct{}
+}
+
+// NewConn creates a Conn on the connection, the connection is closed by Conn.Close
+func NewConn(client *ssh.Client) *Conn {
+	c := &Conn{
+		client:   client,
+		sessions: make(map[int]*trackedSession),
+		doneCh:   make(chan struct{}),
+	}
+	go func() {
+		_ = client.Wait()
+		close(c.doneCh)
+	}()
+	return c
+}
+
+// set the event logger, nil disables logging
+func (c *Conn) SetLogger(logger Logger) {
+	c.logger = logger
+}
+
+func (c *Conn) log() Logger {
+	return loggerOrNop(c.logger)
+}
+
+// Client returns the connection
+func (c *Conn) Client() *ssh.Client {
+	return c.client
+}
+
+// Done is closed when the connection is closed
+func (c *Conn) Done() <-chan struct{} {
+	return c.doneCh
+}
+
+// NewSSHSession opens a tracked session for Terminal, TerminalWithIO or PipeExec
+func (c *Conn) NewSSHSession() (*SSHSession, error) {
+	if c.isClosed() {
+		return nil, ErrConnClosed
+	}
+	session, err := c.client.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	t, err := c.track("", "", session.Close)
+	if err != nil {
+		_ = session.Close()
+		return nil, err
+	}
+	s := NewSSHSession(session)
+	s.SetLogger(c.logger)
+	s.SetClient(c.client)
+	s.conn, s.tracked = c, t
+	return s, nil
+}
+
+// NewCommand creates a command which runs in a tracked session
+func (c *Conn) NewCommand(name string, args ...string) *Command {
+	cmd := NewCommand(c.client, name, args...)
+	cmd.SetLogger(c.logger)
+	cmd.conn = c
+	return cmd
+}
+
+// NewShellCommand creates a shell command which runs in a tracked session
+func (c *Conn) NewShellCommand(script string) *Command {
+	cmd := NewShellCommand(c.client, script)
+	cmd.SetLogger(c.logger)
+	cmd.conn = c
+	return cmd
+}
+
+// NewSCPClient opens a tracked sftp session
+func (c *Conn) NewSCPClient() (*scpClient, error) {
+	if c.isClosed() {
+		return nil, ErrConnClosed
+	}
+	scp, err := NewSCPClient(c.client)
+	if err != nil {
+		return nil, err
+	}
+	t, err := c.track("sftp", "", scp.sftpClient.Close)
+	if err != nil {
+		_ = scp.sftpClient.Close()
+		return nil, err
+	}
+	c.update(t, "sftp", "", SessionRunning, nil)
+	scp.SetLogger(c.logger)
+	scp.conn, scp.tracked = c, t
+	return scp, nil
+}
+
+// Sessions returns the open sessions ordered by ID
+func (c *Conn) Sessions() []SessionInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	infos := make([]SessionInfo, 0, len(c.sessions))
+	for _, t := range c.sessions {
+		infos = append(infos, t.info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	return infos
+}
+
+// Close closes all sessions and the connection
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	sessions := c.sessions
+	c.sessions = make(map[int]*trackedSession)
+	c.mu.Unlock()
+
+	for _, t := range sessions {
+		err := t.closeFn()
+		if err != nil {
+			c.log().Debug("close session failed", "id", t.info.ID, "kind", t.info.Kind, "error", err)
+		}
+	}
+	c.log().Info("connection closed", "sessions", len(sessions))
+	return c.client.Close()
+}
+
+func (c *Conn) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+// track a new session, closeFn is called by Close
+func (c *Conn) track(kind, cmd string, closeFn func() error) (*trackedSession, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil, ErrConnClosed
+	}
+	c.nextID++
+	t := &trackedSession{
+		info:    SessionInfo{ID: c.nextID, Kind: kind, Cmd: cmd, Started: time.Now()},
+		closeFn: closeFn,
+	}
+	c.sessions[t.info.ID] = t
+	c.log().Debug("session opened", "id", t.info.ID, "kind", kind)
+	return t, nil
+}
+
+// update the session state, it is a no-op if the session is not tracked
+func (c *Conn) update(t *trackedSession, kind, cmd string, state SessionState, err error) {
+	if c == nil || t == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if kind != "" {
+		t.info.Kind = kind
+	}
+	if cmd != "" {
+		t.info.Cmd = cmd
+	}
+	t.info.State = state
+	t.info.Err = err
+}
+
+// stop tracking the closed session
+func (c *Conn) untrack(t *trackedSession) {
+	if c == nil || t == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.sessions, t.info.ID)
+}
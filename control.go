@@ -0,0 +1,375 @@
+package sshutils
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ErrControlSocketInUse means another master listens on the control socket
+var ErrControlSocketInUse = errors.New("control socket in use")
+
+// ControlMasterConfig configures a ControlMaster
+type ControlMasterConfig struct {
+	// path of the unix socket, it is created with mode 0600
+	Path string
+	// the master is closed after the last client disconnected and no client
+	// connects in this duration, like ControlPersist of OpenSSH; 0 keeps the
+	// master until Close or the connection is lost
+	Persist time.Duration
+	Logger  Logger
+}
+
+// ControlMaster shares an authenticated connection with other processes
+// through a unix socket, like ControlMaster of OpenSSH. Clients connect by
+// DialControlMaster and get a *ssh.Client whose sessions, sftp and direct
+// tcpip channels are opened on the shared connection. Remote port forwards
+// (tcpip-forward) are not supported through the master.
+//
+// A CLI usually starts a background process which dials the host, creates
+// the master and waits on Done, and every invocation uses DialControlMaster.
+type ControlMaster struct {
+	client   *ssh.Client
+	cfg      ControlMasterConfig
+	listener net.Listener
+	config   *ssh.ServerConfig
+
+	mu        sync.Mutex
+	clients   int
+	idleTimer *time.Timer
+	closed    bool
+	doneCh    chan struct{}
+}
+
+// NewControlMaster listens on the control socket and serves clients over
+// the connection, the connection is closed when the master is closed
+func NewControlMaster(client *ssh.Client, cfg ControlMasterConfig) (*ControlMaster, error) {
+	cfg.Logger = loggerOrNop(cfg.Logger)
+
+	// remove a stale socket left by a dead master
+	if _, err := os.Lstat(cfg.Path); err == nil {
+		conn, err := net.Dial("unix", cfg.Path)
+		if err == nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("%s: %w", cfg.Path, ErrControlSocketInUse)
+		}
+		if err = os.Remove(cfg.Path); err != nil {
+			return nil, err
+		}
+	}
+
+	// the host key is only used on the socket, which is protected by its
+	// mode and the peer credentials
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		return nil, err
+	}
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(signer)
+
+	listener, err := listenControl(cfg.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &ControlMaster{
+		client:   client,
+		cfg:      cfg,
+		listener: listener,
+		config:   config,
+		doneCh:   make(chan struct{}),
+	}
+	m.mu.Lock()
+	m.startPersist()
+	m.mu.Unlock()
+
+	go m.serve()
+	go func() {
+		_ = client.Wait()
+		m.cfg.Logger.Info("control master connection lost", "path", cfg.Path)
+		_ = m.Close()
+	}()
+	m.cfg.Logger.Info("control master started", "path", cfg.Path, "persist", cfg.Persist)
+	return m, nil
+}
+
+// Clients returns the number of connected clients
+func (m *ControlMaster) Clients() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.clients
+}
+
+// Done is closed when the master is closed
+func (m *ControlMaster) Done() <-chan struct{} {
+	return m.doneCh
+}
+
+// Close stops listening, removes the socket and closes the connection,
+// which closes the channels of all clients
+func (m *ControlMaster) Close() error {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return nil
+	}
+	m.closed = true
+	if m.idleTimer != nil {
+		m.idleTimer.Stop()
+	}
+	m.mu.Unlock()
+
+	_ = m.listener.Close()
+	_ = os.Remove(m.cfg.Path)
+	err := m.client.Close()
+	close(m.doneCh)
+	m.cfg.Logger.Info("control master closed", "path", m.cfg.Path)
+	return err
+}
+
+// listen on the socket, it is created in a private directory and moved to
+// path after its mode is set, so it is never accessible by other users
+func listenControl(socketPath string) (*net.UnixListener, error) {
+	dir, err := ioutil.TempDir(filepath.Dir(socketPath), ".sshutils-control-")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	tmpPath := filepath.Join(dir, "sock")
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmpPath, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	// the socket is removed by Close, it is not at tmpPath anymore
+	listener.SetUnlinkOnClose(false)
+	err = os.Chmod(tmpPath, 0600)
+	if err == nil {
+		err = os.Rename(tmpPath, socketPath)
+	}
+	if err != nil {
+		_ = listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// start the persist timer, m.mu must be held
+func (m *ControlMaster) startPersist() {
+	if m.cfg.Persist <= 0 || m.closed {
+		return
+	}
+	m.idleTimer = time.AfterFunc(m.cfg.Persist, func() {
+		m.mu.Lock()
+		idle := m.clients == 0
+		m.mu.Unlock()
+		if idle {
+			m.cfg.Logger.Info("control master persist timeout", "path", m.cfg.Path, "persist", m.cfg.Persist)
+			_ = m.Close()
+		}
+	})
+}
+
+func (m *ControlMaster) serve() {
+	for {
+		conn, err := m.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		m.mu.Lock()
+		m.clients++
+		if m.idleTimer != nil {
+			m.idleTimer.Stop()
+			m.idleTimer = nil
+		}
+		m.mu.Unlock()
+
+		go func() {
+			m.serveConn(conn)
+
+			m.mu.Lock()
+			m.clients--
+			if m.clients == 0 {
+				m.startPersist()
+			}
+			m.mu.Unlock()
+		}()
+	}
+}
+
+// serve a client, its channels and requests are relayed to the connection
+func (m *ControlMaster) serveConn(conn net.Conn) {
+	defer func() {
+		_ = conn.Close()
+	}()
+	log := m.cfg.Logger
+
+	// only the user of the master and root may use the connection, like
+	// OpenSSH does
+	if unixConn, ok := conn.(*net.UnixConn); ok {
+		uid, err := peerUID(unixConn)
+		if err != nil {
+			log.Warn("control client credentials unavailable", "error", err)
+			return
+		}
+		if uid >= 0 && uid != 0 && uid != os.Getuid() {
+			log.Warn("control client rejected", "uid", uid)
+			return
+		}
+	}
+
+	serverConn, chans, reqs, err := ssh.NewServerConn(conn, m.config)
+	if err != nil {
+		log.Debug("control client handshake failed", "error", err)
+		return
+	}
+	defer func() {
+		_ = serverConn.Close()
+	}()
+	log.Debug("control client connected")
+
+	// close the client when the master is closed
+	connDone := make(chan struct{})
+	defer close(connDone)
+	go func() {
+		select {
+		case <-m.doneCh:
+			_ = serverConn.Close()
+		case <-connDone:
+		}
+	}()
+
+	go func() {
+		for req := range reqs {
+			switch req.Type {
+			case "tcpip-forward", "cancel-tcpip-forward":
+				// forwarded-tcpip channels can not be routed back to the client
+				_ = req.Reply(false, nil)
+			default:
+				ok, payload, err := m.client.SendRequest(req.Type, req.WantReply, req.Payload)
+				if err != nil {
+					ok = false
+				}
+				if req.WantReply {
+					_ = req.Reply(ok, payload)
+				}
+			}
+		}
+	}()
+
+	for newChannel := range chans {
+		go m.relayChannel(newChannel)
+	}
+	log.Debug("control client disconnected")
+}
+
+// open the same channel on the connection and relay data and requests
+func (m *ControlMaster) relayChannel(newChannel ssh.NewChannel) {
+	upstream, upReqs, err := m.client.OpenChannel(newChannel.ChannelType(), newChannel.ExtraData())
+	if err != nil {
+		var openErr *ssh.OpenChannelError
+		if errors.As(err, &openErr) {
+			_ = newChannel.Reject(openErr.Reason, openErr.Message)
+		} else {
+			_ = newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		}
+		return
+	}
+	downstream, downReqs, err := newChannel.Accept()
+	if err != nil {
+		_ = upstream.Close()
+		return
+	}
+	m.cfg.Logger.Debug("control channel opened", "type", newChannel.ChannelType())
+
+	// client to server, the client closing the channel closes the upstream channel
+	go func() {
+		_, _ = io.Copy(upstream, downstream)
+		_ = upstream.CloseWrite()
+	}()
+	go func() {
+		for req := range downReqs {
+			ok, err := upstream.SendRequest(req.Type, req.WantReply, req.Payload)
+			if req.WantReply {
+				_ = req.Reply(ok && err == nil, nil)
+			}
+		}
+		_ = upstream.Close()
+	}()
+
+	// server to client, e.g. exit-status, the channel is closed after the
+	// output was relayed and the upstream channel was closed
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		stderrDone := make(chan struct{})
+		go func() {
+			_, _ = io.Copy(downstream.Stderr(), upstream.Stderr())
+			close(stderrDone)
+		}()
+		_, _ = io.Copy(downstream, upstream)
+		<-stderrDone
+		_ = downstream.CloseWrite()
+	}()
+	go func() {
+		defer wg.Done()
+		for req := range upReqs {
+			ok, err := downstream.SendRequest(req.Type, req.WantReply, req.Payload)
+			if req.WantReply {
+				_ = req.Reply(ok && err == nil, nil)
+			}
+		}
+	}()
+	wg.Wait()
+	_ = downstream.Close()
+}
+
+// DialControlMaster connects to the master listening on path and returns a
+// connection whose channels are opened on the shared connection
+func DialControlMaster(path string) (*ssh.Client, error) {
+	unixConn, err := net.Dial("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	// the socket is bound at a temporary path and moved, report its path
+	conn := &controlConn{Conn: unixConn, addr: &net.UnixAddr{Name: path, Net: "unix"}}
+	config := &ssh.ClientConfig{
+		User: "control",
+		// the socket is trusted by its mode and the peer credentials, the
+		// master has an ephemeral key
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         10 * time.Second,
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, path, config)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// controlConn is a client connection of the control socket
+type controlConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c *controlConn) RemoteAddr() net.Addr { return c.addr }
@@ -0,0 +1,333 @@
+package sshutils
+
+import (
+	"bufio"
+	"bytes"
+	"encoding"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Format is the output format of a remote command
+type Format int
+
+const (
+	// FormatJSON is a JSON value, e.g. `docker inspect` or `ip -j addr`
+	FormatJSON Format = iota
+	// FormatNDJSON is newline delimited JSON values, blank lines are skipped
+	FormatNDJSON
+	// FormatCSV is comma separated values with a header line
+	FormatCSV
+	// FormatTSV is tab separated values with a header line, quotes are not special
+	FormatTSV
+)
+
+func (f Format) String() string {
+	switch f {
+	case FormatJSON:
+		return "json"
+	case FormatNDJSON:
+		return "ndjson"
+	case FormatCSV:
+		return "csv"
+	case FormatTSV:
+		return "tsv"
+	default:
+		return "unknown"
+	}
+}
+
+// DecodeError is returned when the output of a remote command can not be
+// decoded, the command itself succeeded
+type DecodeError struct {
+	Host   string
+	Cmd    string
+	Format Format
+	// line of the output, 0 if unknown
+	Line int
+	// captured stderr, may be empty
+	Stderr string
+	Err    error
+}
+
+func (e *DecodeError) Error() string {
+	msg := fmt.Sprintf("decode %s output of remote command %q", e.Format, e.Cmd)
+	if e.Host != "" {
+		msg += " on " + e.Host
+	}
+	if e.Line > 0 {
+		msg += fmt.Sprintf(" at line %d", e.Line)
+	}
+	msg += " failed: " + e.Err.Error()
+	if e.Stderr != "" {
+		msg += ": " + e.Stderr
+	}
+	return msg
+}
+
+func (e *DecodeError) Unwrap() error { return e.Err }
+
+// Decode runs the command and decodes its stdout into v:
+//
+//	FormatJSON      any value accepted by json.Unmarshal
+//	FormatNDJSON    a pointer to a slice, every line is decoded into an element
+//	FormatCSV/TSV   a pointer to []map[string]string, [][]string (the header
+//	                is the first row) or a slice of structs, the columns are
+//	                mapped by the `csv` tag or the case insensitive field name
+//
+// A failed command returns *RemoteExitError and undecodable output returns
+// *DecodeError, both include stderr.
+func (c *Command) Decode(format Format, v interface{}) error {
+	stdout, stderr, err := c.output()
+	if err != nil {
+		return err
+	}
+
+	var line int
+	switch format {
+	case FormatJSON:
+		line, err = decodeJSON(stdout, v)
+	case FormatNDJSON:
+		line, err = decodeNDJSON(stdout, v)
+	case FormatCSV:
+		line, err = decodeCSV(stdout, ',', v)
+	case FormatTSV:
+		line, err = decodeCSV(stdout, '\t', v)
+	default:
+		err = fmt.Errorf("unknown format %d: %w", format, ErrInvalidParameter)
+	}
+	if err != nil {
+		return &DecodeError{
+			Host:   c.client.RemoteAddr().String(),
+			Cmd:    c.String(),
+			Format: format,
+			Line:   line,
+			Stderr: stderr,
+			Err:    err,
+		}
+	}
+	return nil
+}
+
+// line number of the byte offset
+func lineOf(data []byte, offset int64) int {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	return bytes.Count(data[:offset], []byte{'\n'}) + 1
+}
+
+func decodeJSON(data []byte, v interface{}) (int, error) {
+	err := json.Unmarshal(data, v)
+	var syntaxErr *json.SyntaxError
+	if errors.As(err, &syntaxErr) {
+		return lineOf(data, syntaxErr.Offset), err
+	}
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		return lineOf(data, typeErr.Offset), err
+	}
+	return 0, err
+}
+
+// require a pointer to a slice
+func slicePtr(v interface{}) (reflect.Value, error) {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() || rv.Elem().Kind() != reflect.Slice {
+		return reflect.Value{}, fmt.Errorf("%T is not a pointer to a slice: %w", v, ErrInvalidParameter)
+	}
+	return rv.Elem(), nil
+}
+
+func decodeNDJSON(data []byte, v interface{}) (int, error) {
+	slice, err := slicePtr(v)
+	if err != nil {
+		return 0, err
+	}
+
+	r := bufio.NewReader(bytes.NewReader(data))
+	for line := 1; ; line++ {
+		b, err := r.ReadBytes('\n')
+		if len(bytes.TrimSpace(b)) > 0 {
+			elem := reflect.New(slice.Type().Elem())
+			if jsonErr := json.Unmarshal(b, elem.Interface()); jsonErr != nil {
+				return line, jsonErr
+			}
+			slice.Set(reflect.Append(slice, elem.Elem()))
+		}
+		if err == io.EOF {
+			return 0, nil
+		}
+		if err != nil {
+			return line, err
+		}
+	}
+}
+
+func decodeCSV(data []byte, comma rune, v interface{}) (int, error) {
+	slice, err := slicePtr(v)
+	if err != nil {
+		return 0, err
+	}
+
+	var records [][]string
+	if comma == '\t' {
+		records = splitTSV(data)
+	} else {
+		r := csv.NewReader(bytes.NewReader(data))
+		r.Comma = comma
+		r.FieldsPerRecord = -1
+		records, err = r.ReadAll()
+		if err != nil {
+			var parseErr *csv.ParseError
+			if errors.As(err, &parseErr) {
+				return parseErr.Line, parseErr.Err
+			}
+			return 0, err
+		}
+	}
+
+	elemType := slice.Type().Elem()
+	if elemType == reflect.TypeOf([]string(nil)) {
+		for _, record := range records {
+			slice.Set(reflect.Append(slice, reflect.ValueOf(record)))
+		}
+		return 0, nil
+	}
+	if len(records) == 0 {
+		return 0, nil
+	}
+	header := records[0]
+
+	if elemType == reflect.TypeOf(map[string]string(nil)) {
+		for _, record := range records[1:] {
+			m := make(map[string]string, len(header))
+			for i, name := range header {
+				if i < len(record) {
+					m[name] = record[i]
+				}
+			}
+			slice.Set(reflect.Append(slice, reflect.ValueOf(m)))
+		}
+		return 0, nil
+	}
+
+	structType, isPtr := elemType, false
+	if structType.Kind() == reflect.Ptr {
+		structType, isPtr = structType.Elem(), true
+	}
+	if structType.Kind() != reflect.Struct {
+		return 0, fmt.Errorf("unsupported element type %s: %w", elemType, ErrInvalidParameter)
+	}
+	fields := csvFields(structType, header)
+	for n, record := range records[1:] {
+		elem := reflect.New(structType)
+		for i, value := range record {
+			if i >= len(fields) || fields[i] == nil {
+				continue
+			}
+			field := elem.Elem().FieldByIndex(fields[i])
+			if err := setCSVField(field, value); err != nil {
+				return n + 2, fmt.Errorf("column %q: %w", header[i], err)
+			}
+		}
+		if !isPtr {
+			elem = elem.Elem()
+		}
+		slice.Set(reflect.Append(slice, elem))
+	}
+	return 0, nil
+}
+
+// split tab separated values, quotes are not special and empty lines are
+// skipped like encoding/csv does
+func splitTSV(data []byte) [][]string {
+	var records [][]string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		if line == "" {
+			continue
+		}
+		records = append(records, strings.Split(line, "\t"))
+	}
+	return records
+}
+
+// map the header columns to the struct fields, nil if the column is not mapped
+func csvFields(t reflect.Type, header []string) [][]int {
+	fields := make([][]int, len(header))
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			// unexported
+			continue
+		}
+		name := f.Name
+		if tag := f.Tag.Get("csv"); tag != "" {
+			if tag == "-" {
+				continue
+			}
+			name = tag
+		}
+		for j, column := range header {
+			if fields[j] == nil && strings.EqualFold(strings.TrimSpace(column), name) {
+				fields[j] = f.Index
+			}
+		}
+	}
+	return fields
+}
+
+var textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+
+func setCSVField(field reflect.Value, value string) error {
+	unmarshaler := field.CanAddr() && field.Addr().Type().Implements(textUnmarshalerType)
+	if field.Kind() == reflect.String && !unmarshaler {
+		field.SetString(value)
+		return nil
+	}
+	// empty cells keep the zero value
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return nil
+	}
+
+	if unmarshaler {
+		return field.Addr().Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(value))
+	}
+	switch field.Kind() {
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(value, 10, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		n, err := strconv.ParseFloat(value, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetFloat(n)
+	default:
+		return fmt.Errorf("unsupported field type %s", field.Type())
+	}
+	return nil
+}
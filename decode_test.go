@@ -0,0 +1,135 @@
+package sshutils
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+type csvRow struct {
+	Name    string
+	Size    int64 `csv:"bytes"`
+	Ratio   float64
+	Enabled bool
+	Skip    string `csv:"-"`
+	Since   time.Time
+	hidden  string
+}
+
+func TestDecodeCSV(t *testing.T) {
+	since := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	tests := []struct {
+		name     string
+		data     string
+		comma    rune
+		v        interface{}
+		want     interface{}
+		wantLine int
+		wantErr  bool
+	}{
+		{
+			name:  "structs",
+			data:  "name,BYTES,ratio,enabled,skip,since\n a ,10,0.5,true,x,2020-01-02T03:04:05Z\nb,,,,,\n",
+			comma: ',',
+			v:     &[]csvRow{},
+			want:  &[]csvRow{{Name: " a ", Size: 10, Ratio: 0.5, Enabled: true, Since: since}, {Name: "b"}},
+		},
+		{
+			name:  "struct pointers",
+			data:  "name\tbytes\nx\t1\n",
+			comma: '\t',
+			v:     &[]*csvRow{},
+			want:  &[]*csvRow{{Name: "x", Size: 1}},
+		},
+		{
+			name:  "maps",
+			data:  "a,b\n1,2\n3\n",
+			comma: ',',
+			v:     &[]map[string]string{},
+			want:  &[]map[string]string{{"a": "1", "b": "2"}, {"a": "3"}},
+		},
+		{
+			name:  "rows",
+			data:  "a,b\n\"1,2\",3\n",
+			comma: ',',
+			v:     &[][]string{},
+			want:  &[][]string{{"a", "b"}, {"1,2", "3"}},
+		},
+		{
+			name:  "tsv quotes",
+			data:  "a\tb\n\"x\ty\"z\n",
+			comma: '\t',
+			v:     &[][]string{},
+			want:  &[][]string{{"a", "b"}, {`"x`, `y"z`}},
+		},
+		{
+			name:  "empty",
+			data:  "",
+			comma: ',',
+			v:     &[]csvRow{},
+			want:  &[]csvRow{},
+		},
+		{name: "bad number", data: "name,bytes\na,1\nb,x\n", comma: ',', v: &[]csvRow{}, wantLine: 3, wantErr: true},
+		{name: "bad quote", data: "a,b\n1,\"2\n", comma: ',', v: &[][]string{}, wantLine: 2, wantErr: true},
+		{name: "not a slice", data: "a\n1\n", comma: ',', v: &csvRow{}, wantErr: true},
+		{name: "bad element", data: "a\n1\n", comma: ',', v: &[]int{}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			line, err := decodeCSV([]byte(tt.data), tt.comma, tt.v)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("no error, got %+v", tt.v)
+				}
+				if line != tt.wantLine {
+					t.Fatalf("line = %d, want %d: %v", line, tt.wantLine, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(tt.v, tt.want) {
+				t.Fatalf("got %+v, want %+v", tt.v, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeNDJSON(t *testing.T) {
+	type item struct {
+		ID int `json:"id"`
+	}
+	tests := []struct {
+		name     string
+		data     string
+		want     []item
+		wantLine int
+		wantErr  bool
+	}{
+		{name: "lines", data: "{\"id\":1}\n{\"id\":2}\n", want: []item{{1}, {2}}},
+		{name: "blank lines and no newline", data: "\n{\"id\":1}\n  \n{\"id\":2}", want: []item{{1}, {2}}},
+		{name: "crlf", data: "{\"id\":1}\r\n", want: []item{{1}}},
+		{name: "empty", data: ""},
+		{name: "syntax error", data: "{\"id\":1}\n\n{\"id\":\n", wantLine: 3, wantErr: true},
+		{name: "type error", data: "{\"id\":\"x\"}\n", wantLine: 1, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []item
+			line, err := decodeNDJSON([]byte(tt.data), &got)
+			if tt.wantErr {
+				if err == nil || line != tt.wantLine {
+					t.Fatalf("line = %d, err = %v, want line %d", line, err, tt.wantLine)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,51 @@
+package sshutils
+
+import (
+	"errors"
+	"net"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// Dial starts a client connection like ssh.Dial, authentication and host key
+// failures are returned as *AuthError and *HostKeyError
+func Dial(network, addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	return DialWithLogger(network, addr, config, nil)
+}
+
+// DialWithLogger is Dial which emits connect and auth events to logger
+func DialWithLogger(network, addr string, config *ssh.ClientConfig, logger Logger) (*ssh.Client, error) {
+	log := loggerOrNop(logger)
+	log.Debug("connecting", "host", addr, "user", config.User)
+
+	cfg := *config
+	var hostKeyErr error
+	if config.HostKeyCallback != nil {
+		cfg.HostKeyCallback = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			hostKeyErr = config.HostKeyCallback(hostname, remote, key)
+			return hostKeyErr
+		}
+	}
+
+	client, err := ssh.Dial(network, addr, &cfg)
+	if err == nil {
+		log.Info("connected", "host", addr, "user", config.User, "server_version", string(client.ServerVersion()))
+		return client, nil
+	}
+
+	if hostKeyErr != nil {
+		var keyErr *knownhosts.KeyError
+		mismatch := errors.As(hostKeyErr, &keyErr) && len(keyErr.Want) > 0
+		log.Error("host key verification failed", "host", addr, "mismatch", mismatch, "error", hostKeyErr)
+		return nil, &HostKeyError{Host: addr, Mismatch: mismatch, Err: hostKeyErr}
+	}
+	// x/crypto/ssh does not export the authentication error
+	if strings.Contains(err.Error(), "unable to authenticate") {
+		log.Error("authentication failed", "host", addr, "user", config.User, "error", err)
+		return nil, &AuthError{Host: addr, User: config.User, Err: err}
+	}
+	log.Error("connect failed", "host", addr, "error", err)
+	return nil, err
+}
@@ -0,0 +1,179 @@
+package sshutils
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// lines of context around the changes of a unified diff
+const diffContext = 3
+
+// max cells of the LCS table, larger changes are shown as replaced
+const maxDiffCells = 4 << 20
+
+// edit of a line, a and b are the line indexes in the old and new lines,
+// for insertions a is the insert position and for deletions b is
+type diffOp struct {
+	kind byte
+	a, b int
+}
+
+// unifiedDiff returns the unified diff of the old and new content, empty if
+// they are equal
+func unifiedDiff(fromName, toName string, a, b []byte) string {
+	if bytes.Equal(a, b) {
+		return ""
+	}
+	if bytes.IndexByte(a, 0) >= 0 || bytes.IndexByte(b, 0) >= 0 {
+		return fmt.Sprintf("Binary files %s and %s differ\n", fromName, toName)
+	}
+
+	al, bl := splitLines(string(a)), splitLines(string(b))
+	ops := diffLines(al, bl)
+
+	var out strings.Builder
+	out.WriteString("--- " + fromName + "\n")
+	out.WriteString("+++ " + toName + "\n")
+	for i := 0; i < len(ops); {
+		if ops[i].kind == ' ' {
+			i++
+			continue
+		}
+
+		start := i - diffContext
+		if start < 0 {
+			start = 0
+		}
+		// merge the changes separated by less than two contexts
+		end := i
+		for {
+			for end < len(ops) && ops[end].kind != ' ' {
+				end++
+			}
+			next := end
+			for next < len(ops) && ops[next].kind == ' ' && next-end < 2*diffContext {
+				next++
+			}
+			if next < len(ops) && ops[next].kind != ' ' {
+				end = next
+				continue
+			}
+			break
+		}
+		stop := end + diffContext
+		if stop > len(ops) {
+			stop = len(ops)
+		}
+		writeHunk(&out, ops[start:stop], al, bl)
+		i = stop
+	}
+	return out.String()
+}
+
+// split s into lines which keep their newline
+func splitLines(s string) []string {
+	lines := strings.SplitAfter(s, "\n")
+	if len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// the edit script of a to b, deletions before insertions
+func diffLines(a, b []string) []diffOp {
+	var ops []diffOp
+	pre := 0
+	for pre < len(a) && pre < len(b) && a[pre] == b[pre] {
+		ops = append(ops, diffOp{' ', pre, pre})
+		pre++
+	}
+	suf := 0
+	for suf < len(a)-pre && suf < len(b)-pre && a[len(a)-1-suf] == b[len(b)-1-suf] {
+		suf++
+	}
+
+	am, bm := a[pre:len(a)-suf], b[pre:len(b)-suf]
+	n, m := len(am), len(bm)
+	if n*m <= maxDiffCells {
+		// lcs[i][j] is the longest common subsequence of am[i:] and bm[j:]
+		lcs := make([][]int32, n+1)
+		for i := range lcs {
+			lcs[i] = make([]int32, m+1)
+		}
+		for i := n - 1; i >= 0; i-- {
+			for j := m - 1; j >= 0; j-- {
+				switch {
+				case am[i] == bm[j]:
+					lcs[i][j] = lcs[i+1][j+1] + 1
+				case lcs[i+1][j] >= lcs[i][j+1]:
+					lcs[i][j] = lcs[i+1][j]
+				default:
+					lcs[i][j] = lcs[i][j+1]
+				}
+			}
+		}
+		i, j := 0, 0
+		for i < n || j < m {
+			switch {
+			case i < n && j < m && am[i] == bm[j]:
+				ops = append(ops, diffOp{' ', pre + i, pre + j})
+				i++
+				j++
+			case j < m && (i == n || lcs[i][j+1] > lcs[i+1][j]):
+				ops = append(ops, diffOp{'+', pre + i, pre + j})
+				j++
+			default:
+				ops = append(ops, diffOp{'-', pre + i, pre + j})
+				i++
+			}
+		}
+	} else {
+		for i := 0; i < n; i++ {
+			ops = append(ops, diffOp{'-', pre + i, pre})
+		}
+		for j := 0; j < m; j++ {
+			ops = append(ops, diffOp{'+', pre + n, pre + j})
+		}
+	}
+
+	for k := 0; k < suf; k++ {
+		ops = append(ops, diffOp{' ', len(a) - suf + k, len(b) - suf + k})
+	}
+	return ops
+}
+
+func writeHunk(out *strings.Builder, ops []diffOp, a, b []string) {
+	var aCount, bCount int
+	for _, op := range ops {
+		if op.kind != '+' {
+			aCount++
+		}
+		if op.kind != '-' {
+			bCount++
+		}
+	}
+	// an empty range starts at the line before it
+	aStart, bStart := ops[0].a, ops[0].b
+	if aCount > 0 {
+		aStart++
+	}
+	if bCount > 0 {
+		bStart++
+	}
+	fmt.Fprintf(out, "@@ -%d,%d +%d,%d @@\n", aStart, aCount, bStart, bCount)
+
+	for _, op := range ops {
+		var line string
+		if op.kind == '+' {
+			line = b[op.b]
+		} else {
+			line = a[op.a]
+		}
+		out.WriteByte(op.kind)
+		out.WriteString(line)
+		if !strings.HasSuffix(line, "\n") {
+			out.WriteString("\n\\ No newline at end of file\n")
+		}
+	}
+}
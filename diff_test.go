@@ -0,0 +1,136 @@
+package sshutils
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// apply diff to old by patch(1) and return the result
+func applyPatch(t *testing.T, old []byte, diff string) []byte {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "sshutils-diff-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	oldPath := filepath.Join(dir, "old")
+	outPath := filepath.Join(dir, "out")
+	if err = ioutil.WriteFile(oldPath, old, 0644); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command("patch", "-s", "-o", outPath, oldPath)
+	cmd.Stdin = strings.NewReader(diff)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("patch failed: %v: %s\n%s", err, out, diff)
+	}
+	out, err := ioutil.ReadFile(outPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestUnifiedDiff(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b string
+		// expected diff without the file headers, not checked if empty
+		want string
+	}{
+		{name: "equal", a: "a\nb\n", b: "a\nb\n"},
+		{name: "create", a: "", b: "a\nb\n", want: "@@ -0,0 +1,2 @@\n+a\n+b\n"},
+		{name: "remove all", a: "a\nb\n", b: "", want: "@@ -1,2 +0,0 @@\n-a\n-b\n"},
+		{name: "change", a: "a\nb\nc\n", b: "a\nx\nc\n", want: "@@ -1,3 +1,3 @@\n a\n-b\n+x\n c\n"},
+		{name: "append", a: "a\n", b: "a\nb\n", want: "@@ -1,1 +1,2 @@\n a\n+b\n"},
+		{name: "insert at start", a: "b\nc\n", b: "a\nb\nc\n", want: "@@ -1,2 +1,3 @@\n+a\n b\n c\n"},
+		{
+			name: "no newline at end",
+			a:    "a\nb",
+			b:    "a\nb\n",
+			want: "@@ -1,2 +1,2 @@\n a\n-b\n\\ No newline at end of file\n+b\n",
+		},
+		{
+			name: "context",
+			a:    "1\n2\n3\n4\n5\n6\n7\n8\n9\n",
+			b:    "1\n2\n3\n4\nx\n6\n7\n8\n9\n",
+			want: "@@ -2,7 +2,7 @@\n 2\n 3\n 4\n-5\n+x\n 6\n 7\n 8\n",
+		},
+		{
+			name: "two hunks",
+			a:    "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n",
+			b:    "x\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\ny\n",
+			want: "@@ -1,4 +1,4 @@\n-1\n+x\n 2\n 3\n 4\n@@ -9,4 +9,4 @@\n 9\n 10\n 11\n-12\n+y\n",
+		},
+		{
+			name: "merged hunk",
+			a:    "1\n2\n3\n4\n5\n6\n7\n8\n",
+			b:    "x\n2\n3\n4\n5\n6\n7\ny\n",
+			want: "@@ -1,8 +1,8 @@\n-1\n+x\n 2\n 3\n 4\n 5\n 6\n 7\n-8\n+y\n",
+		},
+		{name: "crlf", a: "a\r\nb\r\n", b: "a\r\nc\r\n", want: "@@ -1,2 +1,2 @@\n a\r\n-b\r\n+c\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			diff := unifiedDiff("old", "new", []byte(tt.a), []byte(tt.b))
+			if tt.a == tt.b {
+				if diff != "" {
+					t.Fatalf("diff of equal content: %q", diff)
+				}
+				return
+			}
+			if !strings.HasPrefix(diff, "--- old\n+++ new\n") {
+				t.Fatalf("bad header: %q", diff)
+			}
+			if tt.want != "" && diff[len("--- old\n+++ new\n"):] != tt.want {
+				t.Fatalf("diff =\n%s\nwant\n%s", diff, tt.want)
+			}
+			if _, err := exec.LookPath("patch"); err != nil {
+				return
+			}
+			if got := applyPatch(t, []byte(tt.a), diff); !bytes.Equal(got, []byte(tt.b)) {
+				t.Fatalf("patched = %q, want %q\n%s", got, tt.b, diff)
+			}
+		})
+	}
+}
+
+func TestUnifiedDiffBinary(t *testing.T) {
+	diff := unifiedDiff("old", "new", []byte("a\x00b"), []byte("a\x00c"))
+	if diff != "Binary files old and new differ\n" {
+		t.Fatalf("diff = %q", diff)
+	}
+}
+
+func TestUnifiedDiffPatch(t *testing.T) {
+	if _, err := exec.LookPath("patch"); err != nil {
+		t.Skip("patch not found")
+	}
+	words := []string{"a\n", "b\n", "c\n", "d\n", "e\n"}
+	random := func(r *rand.Rand) []byte {
+		var buf bytes.Buffer
+		for i := r.Intn(30); i > 0; i-- {
+			buf.WriteString(words[r.Intn(len(words))])
+		}
+		return buf.Bytes()
+	}
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 200; i++ {
+		a, b := random(r), random(r)
+		diff := unifiedDiff("old", "new", a, b)
+		if bytes.Equal(a, b) {
+			continue
+		}
+		if got := applyPatch(t, a, diff); !bytes.Equal(got, b) {
+			t.Fatalf("patched = %q, want %q\n%s", got, b, diff)
+		}
+	}
+}
@@ -0,0 +1,402 @@
+package sshutils
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+// EnsureResult is the result of an idempotent file operation
+type EnsureResult struct {
+	Path string
+	// true if the remote path was changed, or would be changed in check mode
+	Changed bool
+	// unified diff of the content, empty if the content is unchanged
+	Diff string
+	// the changes, e.g. "created", "mode 0644 -> 0600", "owner 0 -> 1000"
+	Changes []string
+}
+
+// FileAttrs are the attributes of an ensured file or directory, zero fields
+// are not managed; new files are created with 0644 and directories with 0755
+type FileAttrs struct {
+	Mode os.FileMode
+	// user name or uid
+	Owner string
+	// group name or gid
+	Group string
+}
+
+// SetCheckMode enables the check (dry-run) mode, Ensure operations report
+// the changes without applying them
+func (s *scpClient) SetCheckMode(check bool) {
+	s.checkMode = check
+}
+
+// EnsureFile ensures the remote file has the content and attributes, it is
+// only written if the content differs
+func (s *scpClient) EnsureFile(remotePath string, content []byte, attrs FileAttrs) (*EnsureResult, error) {
+	remotePath = s.replaceHome(remotePath, false)
+	res := &EnsureResult{Path: remotePath}
+
+	info, old, err := s.readEnsured(remotePath)
+	if err != nil {
+		return nil, s.wrapError("ensure", remotePath, true, err)
+	}
+	uid, gid, err := s.lookupOwner(attrs)
+	if err != nil {
+		return nil, s.pathError("ensure", remotePath, err)
+	}
+
+	mode := attrs.Mode.Perm()
+	fromName := remotePath
+	if info == nil {
+		res.Changes = append(res.Changes, "created")
+		fromName = "/dev/null"
+		if mode == 0 {
+			mode = 0644
+		}
+	} else {
+		if mode == 0 {
+			mode = info.Mode().Perm()
+		}
+		res.Changes = append(res.Changes, attrChanges(info, mode, uid, gid)...)
+	}
+	contentChanged := info == nil || !bytes.Equal(old, content)
+	if contentChanged {
+		res.Diff = unifiedDiff(fromName, remotePath, old, content)
+		if info != nil {
+			res.Changes = append(res.Changes, "content")
+		}
+	}
+	res.Changed = len(res.Changes) > 0
+	if !res.Changed || s.checkMode {
+		s.logEnsure(res)
+		return res, nil
+	}
+
+	// an atomic write replaces the file by a new one of the login user, keep
+	// the owner and group unless they are managed
+	if contentChanged && info != nil && s.atomic {
+		if stat, ok := info.Sys().(*sftp.FileStat); ok {
+			if uid < 0 {
+				uid = int(stat.UID)
+			}
+			if gid < 0 {
+				gid = int(stat.GID)
+			}
+		}
+	}
+	if contentChanged {
+		err = s.writeRemote(context.Background(), bytes.NewReader(content), remotePath, int64(len(content)), mode, time.Time{}, false)
+		if err != nil {
+			return nil, s.wrapError("ensure", remotePath, true, err)
+		}
+	}
+	err = s.applyAttrs(remotePath, mode, uid, gid)
+	if err != nil {
+		return nil, s.wrapError("ensure", remotePath, true, err)
+	}
+	s.logEnsure(res)
+	return res, nil
+}
+
+// EnsureTemplate renders the template with data and ensures the remote
+// file has the output, see EnsureFile
+func (s *scpClient) EnsureTemplate(remotePath string, tmpl *template.Template, data interface{}, attrs FileAttrs) (*EnsureResult, error) {
+	var buf bytes.Buffer
+	err := tmpl.Execute(&buf, data)
+	if err != nil {
+		return nil, s.pathError("render", remotePath, err)
+	}
+	return s.EnsureFile(remotePath, buf.Bytes(), attrs)
+}
+
+// EnsureLine ensures the remote file contains the line. If match is not
+// nil, the last line matching it is replaced by line; otherwise, or if no
+// line matches, line is appended unless present. A missing file is created.
+func (s *scpClient) EnsureLine(remotePath, line string, match *regexp.Regexp) (*EnsureResult, error) {
+	remotePath = s.replaceHome(remotePath, false)
+	_, old, err := s.readEnsured(remotePath)
+	if err != nil {
+		return nil, s.wrapError("ensure", remotePath, true, err)
+	}
+
+	lines := splitLines(string(old))
+	matched := -1
+	for i, l := range lines {
+		text := strings.TrimRight(l, "\r\n")
+		if match != nil && match.MatchString(text) {
+			matched = i
+		}
+		if match == nil && text == line {
+			matched = i
+		}
+	}
+
+	content := string(old)
+	switch {
+	case matched >= 0:
+		// keep the line ending
+		ending := lines[matched][len(strings.TrimRight(lines[matched], "\r\n")):]
+		lines[matched] = line + ending
+		content = strings.Join(lines, "")
+	default:
+		present := false
+		for _, l := range lines {
+			if strings.TrimRight(l, "\r\n") == line {
+				present = true
+			}
+		}
+		if !present {
+			if content != "" && !strings.HasSuffix(content, "\n") {
+				content += "\n"
+			}
+			content += line + "\n"
+		}
+	}
+	return s.EnsureFile(remotePath, []byte(content), FileAttrs{})
+}
+
+// EnsureDir ensures the remote directory and its parents exist, attrs are
+// applied to the directory only
+func (s *scpClient) EnsureDir(remotePath string, attrs FileAttrs) (*EnsureResult, error) {
+	remotePath = s.replaceHome(remotePath, false)
+	res := &EnsureResult{Path: remotePath}
+
+	info, err := s.sftpClient.Stat(remotePath)
+	if err != nil && !isNotExist(err) {
+		return nil, s.wrapError("ensure", remotePath, true, err)
+	}
+	if err == nil && !info.IsDir() {
+		return nil, s.pathError("ensure", remotePath, ErrNotDir)
+	}
+	if err != nil {
+		info = nil
+	}
+	uid, gid, err := s.lookupOwner(attrs)
+	if err != nil {
+		return nil, s.pathError("ensure", remotePath, err)
+	}
+
+	mode := attrs.Mode.Perm()
+	if info == nil {
+		res.Changes = append(res.Changes, "created")
+		if mode == 0 {
+			mode = 0755
+		}
+	} else {
+		if mode == 0 {
+			mode = info.Mode().Perm()
+		}
+		res.Changes = append(res.Changes, attrChanges(info, mode, uid, gid)...)
+	}
+	res.Changed = len(res.Changes) > 0
+	if !res.Changed || s.checkMode {
+		s.logEnsure(res)
+		return res, nil
+	}
+
+	if info == nil {
+		err = s.sftpClient.MkdirAll(remotePath)
+		if err != nil {
+			return nil, s.wrapError("ensure", remotePath, true, err)
+		}
+	}
+	err = s.applyAttrs(remotePath, mode, uid, gid)
+	if err != nil {
+		return nil, s.wrapError("ensure", remotePath, true, err)
+	}
+	s.logEnsure(res)
+	return res, nil
+}
+
+// EnsureAbsent ensures the remote path does not exist, directories are
+// removed recursively and symlinks are removed, not their targets
+func (s *scpClient) EnsureAbsent(remotePath string) (*EnsureResult, error) {
+	remotePath = s.replaceHome(remotePath, false)
+	res := &EnsureResult{Path: remotePath}
+
+	info, err := s.sftpClient.Lstat(remotePath)
+	if err != nil {
+		if isNotExist(err) {
+			return res, nil
+		}
+		return nil, s.wrapError("ensure", remotePath, true, err)
+	}
+
+	res.Changed = true
+	res.Changes = []string{"removed"}
+	if info.Mode().IsRegular() {
+		_, old, err := s.readEnsured(remotePath)
+		if err != nil {
+			return nil, s.wrapError("ensure", remotePath, true, err)
+		}
+		res.Diff = unifiedDiff(remotePath, "/dev/null", old, nil)
+	}
+	if s.checkMode {
+		s.logEnsure(res)
+		return res, nil
+	}
+
+	err = s.removeRemoteAll(remotePath, info)
+	if err != nil {
+		return nil, s.wrapError("ensure", remotePath, true, err)
+	}
+	s.logEnsure(res)
+	return res, nil
+}
+
+func (s *scpClient) logEnsure(res *EnsureResult) {
+	if res.Changed {
+		s.log().Info("ensure changed", "host", s.host(), "path", res.Path, "changes", strings.Join(res.Changes, ", "), "check", s.checkMode)
+		return
+	}
+	s.log().Debug("ensure unchanged", "host", s.host(), "path", res.Path)
+}
+
+// read the remote file, info is nil if it does not exist
+func (s *scpClient) readEnsured(remotePath string) (os.FileInfo, []byte, error) {
+	info, err := s.sftpClient.Stat(remotePath)
+	if err != nil {
+		if isNotExist(err) {
+			return nil, nil, nil
+		}
+		return nil, nil, err
+	}
+	if info.IsDir() {
+		return nil, nil, s.pathError("ensure", remotePath, ErrIsDir)
+	}
+
+	f, err := s.sftpClient.Open(remotePath)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	content, err := ioutil.ReadAll(f)
+	return info, content, err
+}
+
+// the attribute changes of an existing path, uid and gid are -1 if not managed
+func attrChanges(info os.FileInfo, mode os.FileMode, uid, gid int) []string {
+	var changes []string
+	if info.Mode().Perm() != mode {
+		changes = append(changes, fmt.Sprintf("mode %04o -> %04o", info.Mode().Perm(), mode))
+	}
+	if stat, ok := info.Sys().(*sftp.FileStat); ok {
+		if uid >= 0 && int(stat.UID) != uid {
+			changes = append(changes, fmt.Sprintf("owner %d -> %d", stat.UID, uid))
+		}
+		if gid >= 0 && int(stat.GID) != gid {
+			changes = append(changes, fmt.Sprintf("group %d -> %d", stat.GID, gid))
+		}
+	}
+	return changes
+}
+
+// apply mode and owner, uid and gid are -1 if not managed
+func (s *scpClient) applyAttrs(remotePath string, mode os.FileMode, uid, gid int) error {
+	err := s.sftpClient.Chmod(remotePath, mode)
+	if err != nil {
+		return err
+	}
+	if uid < 0 && gid < 0 {
+		return nil
+	}
+
+	// sftp sets both ids, keep the unmanaged one
+	if uid < 0 || gid < 0 {
+		info, err := s.sftpClient.Stat(remotePath)
+		if err != nil {
+			return err
+		}
+		if stat, ok := info.Sys().(*sftp.FileStat); ok {
+			if uid < 0 {
+				uid = int(stat.UID)
+			}
+			if gid < 0 {
+				gid = int(stat.GID)
+			}
+		}
+	}
+	return s.sftpClient.Chown(remotePath, uid, gid)
+}
+
+// resolve the owner and group names to ids on the remote host, -1 if not managed
+func (s *scpClient) lookupOwner(attrs FileAttrs) (int, int, error) {
+	uid, err := s.lookupID(attrs.Owner, false)
+	if err != nil {
+		return -1, -1, err
+	}
+	gid, err := s.lookupID(attrs.Group, true)
+	if err != nil {
+		return -1, -1, err
+	}
+	return uid, gid, nil
+}
+
+func (s *scpClient) lookupID(name string, group bool) (int, error) {
+	if name == "" {
+		return -1, nil
+	}
+	if id, err := strconv.Atoi(name); err == nil {
+		return id, nil
+	}
+
+	kind := "user"
+	cmd := NewCommand(s.sshClient, "id", "-u", name)
+	if group {
+		kind = "group"
+		// getent is missing on BusyBox
+		cmd = NewShellCommand(s.sshClient, "getent group "+ShellQuote(name)+" 2>/dev/null || grep "+ShellQuote("^"+name+":")+" /etc/group")
+	}
+	out, err := cmd.Output()
+	if err != nil {
+		return -1, fmt.Errorf("unknown %s %q: %w", kind, name, ErrInvalidParameter)
+	}
+
+	field := strings.TrimSpace(string(out))
+	if group {
+		// name:password:gid:members
+		parts := strings.Split(firstLine(field), ":")
+		if len(parts) < 3 {
+			return -1, fmt.Errorf("unknown group %q: %w", name, ErrInvalidParameter)
+		}
+		field = parts[2]
+	}
+	id, err := strconv.Atoi(field)
+	if err != nil {
+		return -1, fmt.Errorf("bad %s id %q of %q: %w", kind, field, name, ErrInvalidParameter)
+	}
+	return id, nil
+}
+
+// remove the remote path recursively, info is its Lstat
+func (s *scpClient) removeRemoteAll(remotePath string, info os.FileInfo) error {
+	if !info.IsDir() {
+		return s.sftpClient.Remove(remotePath)
+	}
+	entries, err := s.sftpClient.ReadDir(remotePath)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		err = s.removeRemoteAll(path.Join(remotePath, entry.Name()), entry)
+		if err != nil {
+			return err
+		}
+	}
+	return s.sftpClient.RemoveDirectory(remotePath)
+}
@@ -0,0 +1,271 @@
+package sshutils
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"text/template"
+)
+
+func TestEnsure(t *testing.T) {
+	uid := strconv.Itoa(os.Getuid())
+	me, err := user.Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// steps run in order against the same directory
+	tests := []struct {
+		name   string
+		check  bool
+		atomic bool
+		run    func(s *scpClient, dir string) (*EnsureResult, error)
+		// file or directory in dir, with its content and mode after the step
+		path        string
+		wantContent string
+		wantMode    os.FileMode
+		wantChanges []string
+		wantDiff    bool
+		wantErr     error
+	}{
+		{
+			name:  "create file in check mode",
+			check: true,
+			run: func(s *scpClient, dir string) (*EnsureResult, error) {
+				return s.EnsureFile(filepath.Join(dir, "f"), []byte("a\n"), FileAttrs{})
+			},
+			path:        "f",
+			wantChanges: []string{"created"},
+			wantDiff:    true,
+		},
+		{
+			name: "create file",
+			run: func(s *scpClient, dir string) (*EnsureResult, error) {
+				return s.EnsureFile(filepath.Join(dir, "f"), []byte("a\n"), FileAttrs{})
+			},
+			path:        "f",
+			wantContent: "a\n",
+			wantMode:    0644,
+			wantChanges: []string{"created"},
+			wantDiff:    true,
+		},
+		{
+			name: "file unchanged",
+			run: func(s *scpClient, dir string) (*EnsureResult, error) {
+				return s.EnsureFile(filepath.Join(dir, "f"), []byte("a\n"), FileAttrs{Owner: uid, Group: strconv.Itoa(os.Getgid())})
+			},
+			path:        "f",
+			wantContent: "a\n",
+			wantMode:    0644,
+		},
+		{
+			name:  "file mode in check mode",
+			check: true,
+			run: func(s *scpClient, dir string) (*EnsureResult, error) {
+				return s.EnsureFile(filepath.Join(dir, "f"), []byte("a\n"), FileAttrs{Mode: 0600})
+			},
+			path:        "f",
+			wantContent: "a\n",
+			wantMode:    0644,
+			wantChanges: []string{"mode 0644 -> 0600"},
+		},
+		{
+			name:   "file content and mode atomic",
+			atomic: true,
+			run: func(s *scpClient, dir string) (*EnsureResult, error) {
+				return s.EnsureFile(filepath.Join(dir, "f"), []byte("b\n"), FileAttrs{Mode: 0600, Owner: me.Username})
+			},
+			path:        "f",
+			wantContent: "b\n",
+			wantMode:    0600,
+			wantChanges: []string{"mode 0644 -> 0600", "content"},
+			wantDiff:    true,
+		},
+		{
+			name: "template",
+			run: func(s *scpClient, dir string) (*EnsureResult, error) {
+				tmpl := template.Must(template.New("t").Parse("port={{.}}\n"))
+				return s.EnsureTemplate(filepath.Join(dir, "f"), tmpl, 22, FileAttrs{})
+			},
+			path:        "f",
+			wantContent: "port=22\n",
+			wantMode:    0600,
+			wantChanges: []string{"content"},
+			wantDiff:    true,
+		},
+		{
+			name: "append line",
+			run: func(s *scpClient, dir string) (*EnsureResult, error) {
+				return s.EnsureLine(filepath.Join(dir, "f"), "user=a", nil)
+			},
+			path:        "f",
+			wantContent: "port=22\nuser=a\n",
+			wantMode:    0600,
+			wantChanges: []string{"content"},
+			wantDiff:    true,
+		},
+		{
+			name: "line present",
+			run: func(s *scpClient, dir string) (*EnsureResult, error) {
+				return s.EnsureLine(filepath.Join(dir, "f"), "port=22", nil)
+			},
+			path:        "f",
+			wantContent: "port=22\nuser=a\n",
+			wantMode:    0600,
+		},
+		{
+			name: "replace line",
+			run: func(s *scpClient, dir string) (*EnsureResult, error) {
+				return s.EnsureLine(filepath.Join(dir, "f"), "port=2222", regexp.MustCompile(`^port=`))
+			},
+			path:        "f",
+			wantContent: "port=2222\nuser=a\n",
+			wantMode:    0600,
+			wantChanges: []string{"content"},
+			wantDiff:    true,
+		},
+		{
+			name: "line in new file",
+			run: func(s *scpClient, dir string) (*EnsureResult, error) {
+				return s.EnsureLine(filepath.Join(dir, "g"), "x", regexp.MustCompile(`^y`))
+			},
+			path:        "g",
+			wantContent: "x\n",
+			wantMode:    0644,
+			wantChanges: []string{"created"},
+			wantDiff:    true,
+		},
+		{
+			name: "create dir",
+			run: func(s *scpClient, dir string) (*EnsureResult, error) {
+				return s.EnsureDir(filepath.Join(dir, "d/e"), FileAttrs{Mode: 0700})
+			},
+			path:        "d/e",
+			wantMode:    os.ModeDir | 0700,
+			wantChanges: []string{"created"},
+		},
+		{
+			name: "dir unchanged",
+			run: func(s *scpClient, dir string) (*EnsureResult, error) {
+				return s.EnsureDir(filepath.Join(dir, "d/e"), FileAttrs{})
+			},
+			path:     "d/e",
+			wantMode: os.ModeDir | 0700,
+		},
+		{
+			name: "dir over file",
+			run: func(s *scpClient, dir string) (*EnsureResult, error) {
+				return s.EnsureDir(filepath.Join(dir, "g"), FileAttrs{})
+			},
+			wantErr: ErrNotDir,
+		},
+		{
+			name: "file over dir",
+			run: func(s *scpClient, dir string) (*EnsureResult, error) {
+				return s.EnsureFile(filepath.Join(dir, "d"), nil, FileAttrs{})
+			},
+			wantErr: ErrIsDir,
+		},
+		{
+			name:  "remove dir in check mode",
+			check: true,
+			run: func(s *scpClient, dir string) (*EnsureResult, error) {
+				return s.EnsureAbsent(filepath.Join(dir, "d"))
+			},
+			path:        "d/e",
+			wantMode:    os.ModeDir | 0700,
+			wantChanges: []string{"removed"},
+		},
+		{
+			name: "remove dir",
+			run: func(s *scpClient, dir string) (*EnsureResult, error) {
+				return s.EnsureAbsent(filepath.Join(dir, "d"))
+			},
+			path:        "d",
+			wantChanges: []string{"removed"},
+		},
+		{
+			name: "remove file",
+			run: func(s *scpClient, dir string) (*EnsureResult, error) {
+				return s.EnsureAbsent(filepath.Join(dir, "g"))
+			},
+			path:        "g",
+			wantChanges: []string{"removed"},
+			wantDiff:    true,
+		},
+		{
+			name: "absent",
+			run: func(s *scpClient, dir string) (*EnsureResult, error) {
+				return s.EnsureAbsent(filepath.Join(dir, "g"))
+			},
+			path: "g",
+		},
+	}
+
+	s := newTestSCPClient(t)
+	dir, err := ioutil.TempDir("", "sshutils-ensure-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	for _, tt := range tests {
+		s.SetCheckMode(tt.check)
+		s.SetAtomic(tt.atomic)
+		res, err := tt.run(s, dir)
+		if tt.wantErr != nil {
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("%s: error %v, want %v", tt.name, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if res.Changed != (len(tt.wantChanges) > 0) || !reflect.DeepEqual(res.Changes, tt.wantChanges) {
+			t.Errorf("%s: changed %v, changes %q, want %q", tt.name, res.Changed, res.Changes, tt.wantChanges)
+		}
+		if (res.Diff != "") != tt.wantDiff {
+			t.Errorf("%s: diff %q", tt.name, res.Diff)
+		}
+
+		p := filepath.Join(dir, filepath.FromSlash(tt.path))
+		info, err := os.Stat(p)
+		if tt.wantMode == 0 {
+			if err == nil {
+				t.Errorf("%s: %s exists", tt.name, tt.path)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if info.Mode() != tt.wantMode {
+			t.Errorf("%s: mode %v, want %v", tt.name, info.Mode(), tt.wantMode)
+		}
+		if !info.IsDir() {
+			if b, _ := ioutil.ReadFile(p); string(b) != tt.wantContent {
+				t.Errorf("%s: content %q, want %q", tt.name, b, tt.wantContent)
+			}
+		}
+	}
+
+	// no temp files of the atomic writes are left
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if strings.HasSuffix(e.Name(), ".tmp") {
+			t.Errorf("temp file %s left", e.Name())
+		}
+	}
+}
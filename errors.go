@@ -0,0 +1,190 @@
+package sshutils
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	// ErrExist means the destination already exists
+	ErrExist = os.ErrExist
+	// ErrNotExist means the path does not exist
+	ErrNotExist = os.ErrNotExist
+	// ErrPermission means permission denied
+	ErrPermission = os.ErrPermission
+	// ErrNotDir means a directory is required but the path is not a directory
+	ErrNotDir = errors.New("not a directory")
+	// ErrIsDir means a file is required but the path is a directory
+	ErrIsDir = errors.New("is a directory")
+	// ErrInvalidParameter means the arguments are invalid
+	ErrInvalidParameter = errors.New("parameter invalid")
+	// ErrNoMatch means a glob pattern matched nothing
+	ErrNoMatch = errors.New("no matches found")
+	// ErrAuth means the authentication failed
+	ErrAuth = errors.New("authentication failed")
+	// ErrHostKeyMismatch means the host key does not match the known key
+	ErrHostKeyMismatch = errors.New("host key mismatch")
+	// ErrHostKeyUnknown means the host key is not known
+	ErrHostKeyUnknown = errors.New("host key unknown")
+)
+
+// PathError records an error and the operation and path that caused it,
+// Host is empty for local paths
+type PathError struct {
+	Op   string
+	Host string
+	Path string
+	Err  error
+}
+
+func (e *PathError) Error() string {
+	if e.Host == "" {
+		return e.Op + " " + e.Path + ": " + e.Err.Error()
+	}
+	return e.Op + " " + e.Host + ":" + e.Path + ": " + e.Err.Error()
+}
+
+func (e *PathError) Unwrap() error { return e.Err }
+
+// RemoteExitError is returned when a remote command failed
+type RemoteExitError struct {
+	// empty if the host is unknown, e.g. for SSHSession
+	Host string
+	Cmd  string
+	// exit status, -1 if the command was killed by a signal or exited without status
+	Status int
+	// signal name without "SIG" prefix, empty if not killed by a signal
+	Signal string
+	// captured stderr, may be empty
+	Stderr string
+	Err    error
+}
+
+func (e *RemoteExitError) Error() string {
+	msg := fmt.Sprintf("remote command %q failed: %v", e.Cmd, e.Err)
+	if e.Host != "" {
+		msg = fmt.Sprintf("remote command %q on %s failed: %v", e.Cmd, e.Host, e.Err)
+	}
+	if e.Stderr != "" {
+		msg += ": " + e.Stderr
+	}
+	return msg
+}
+
+func (e *RemoteExitError) Unwrap() error { return e.Err }
+
+// wrap a remote command error, other errors than *ssh.ExitError and
+// *ssh.ExitMissingError are returned as is
+func newRemoteExitError(host, cmd, stderr string, err error) error {
+	switch exitErr := err.(type) {
+	case *ssh.ExitError:
+		return &RemoteExitError{
+			Host:   host,
+			Cmd:    cmd,
+			Status: exitErr.ExitStatus(),
+			Signal: exitErr.Signal(),
+			Stderr: strings.TrimSpace(stderr),
+			Err:    err,
+		}
+	case *ssh.ExitMissingError:
+		return &RemoteExitError{
+			Host:   host,
+			Cmd:    cmd,
+			Status: -1,
+			Stderr: strings.TrimSpace(stderr),
+			Err:    err,
+		}
+	default:
+		return err
+	}
+}
+
+// AuthError is returned when the authentication failed
+type AuthError struct {
+	Host string
+	User string
+	Err  error
+}
+
+func (e *AuthError) Error() string {
+	return "authentication failed for " + e.User + "@" + e.Host + ": " + e.Err.Error()
+}
+
+func (e *AuthError) Unwrap() error { return e.Err }
+
+func (e *AuthError) Is(target error) bool { return target == ErrAuth }
+
+// HostKeyError is returned when the host key callback rejected the host key
+type HostKeyError struct {
+	Host string
+	// true if the host is known with another key
+	Mismatch bool
+	Err      error
+}
+
+func (e *HostKeyError) Error() string {
+	return "host key verification failed for " + e.Host + ": " + e.Err.Error()
+}
+
+func (e *HostKeyError) Unwrap() error { return e.Err }
+
+func (e *HostKeyError) Is(target error) bool {
+	if e.Mismatch {
+		return target == ErrHostKeyMismatch
+	}
+	return target == ErrHostKeyUnknown
+}
+
+// remote host of the scp client
+func (s *scpClient) host() string {
+	return s.sshClient.RemoteAddr().String()
+}
+
+// remote host of the session, empty if the connection is not set
+func (s *SSHSession) host() string {
+	if s.client == nil {
+		return ""
+	}
+	return s.client.RemoteAddr().String()
+}
+
+// remote path error
+func (s *scpClient) pathError(op, p string, err error) error {
+	return &PathError{Op: op, Host: s.host(), Path: p, Err: err}
+}
+
+// wrap untyped errors returned by the exported scp functions, remote is
+// true if p is a remote path
+func (s *scpClient) wrapError(op, p string, remote bool, err error) error {
+	if err == nil {
+		return nil
+	}
+	if kaErr := s.keepAlive.Err(); kaErr != nil {
+		return kaErr
+	}
+
+	var pathErr *PathError
+	var checksumErr *ChecksumError
+	var exitErr *RemoteExitError
+	if errors.As(err, &pathErr) || errors.As(err, &checksumErr) || errors.As(err, &exitErr) {
+		return err
+	}
+	// local errors already contain the path
+	var osPathErr *os.PathError
+	if errors.As(err, &osPathErr) {
+		return &PathError{Op: op, Path: osPathErr.Path, Err: err}
+	}
+	if !remote {
+		return &PathError{Op: op, Path: p, Err: err}
+	}
+	return s.pathError(op, p, err)
+}
+
+// check the error means not exist, local or remote
+func isNotExist(err error) bool {
+	return errors.Is(err, os.ErrNotExist)
+}
@@ -0,0 +1,296 @@
+package sshutils
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// NoEscape disables escape sequences, see SSHSession.SetEscapeChar
+const NoEscape = -1
+
+// default escape character of OpenSSH
+const defaultEscapeChar = '~'
+
+const escapeHelp = `Supported escape sequences:
+ %[1]c.   - terminate connection
+ %[1]cC   - open a command line
+ %[1]c^Z  - suspend ssh
+ %[1]c#   - list forwarded connections
+ %[1]c?   - this message
+ %[1]c%[1]c   - send the escape character by typing it twice
+(Note that escapes are only recognized immediately after newline.)
+`
+
+const escapeCommandHelp = `Commands:
+      -L[bind_address:]port:host:hostport    Request local forward
+      -R[bind_address:]port:host:hostport    Request remote forward
+      -KL[bind_address:]port                 Cancel local forward
+      -KR[bind_address:]port                 Cancel remote forward
+`
+
+// escapeHandler handles OpenSSH style escape sequences of the terminal
+// input, the escape character is only recognized after newline
+type escapeHandler struct {
+	char byte
+	// local terminal output for messages
+	out io.Writer
+	// close the connection
+	disconnect func()
+	// suspend the process, nil if not supported
+	suspend func()
+	// run a command line command, returns the message to print
+	command func(line string) string
+	// list forwarded connections
+	list func() string
+
+	// true if disconnected by the escape sequence
+	disconnected bool
+	afterNewline bool
+	pending      bool
+	inCommand    bool
+	commandLine  []byte
+}
+
+func newEscapeHandler(char byte, out io.Writer) *escapeHandler {
+	return &escapeHandler{
+		char:         char,
+		out:          out,
+		afterNewline: true,
+	}
+}
+
+// print a message to the local terminal, which is in raw mode
+func (e *escapeHandler) print(msg string) {
+	msg = strings.Replace(strings.TrimRight(msg, "\n"), "\n", "\r\n", -1)
+	_, _ = io.WriteString(e.out, msg+"\r\n")
+}
+
+// filter returns the input which should be sent to the remote side
+func (e *escapeHandler) filter(p []byte) []byte {
+	var out bytes.Buffer
+	for _, b := range p {
+		if e.inCommand {
+			e.commandInput(b)
+			continue
+		}
+
+		if e.pending {
+			e.pending = false
+			switch b {
+			case '.':
+				e.print(string(e.char) + ".")
+				e.disconnected = true
+				e.disconnect()
+				return out.Bytes()
+			case 0x1a:
+				if e.suspend == nil {
+					e.print(string(e.char) + "^Z [suspend not supported]")
+					continue
+				}
+				e.print(string(e.char) + "^Z [suspend ssh]")
+				e.suspend()
+				continue
+			case '#':
+				e.print(string(e.char) + "#")
+				if e.list != nil {
+					e.print(e.list())
+				}
+				continue
+			case 'C':
+				e.inCommand = true
+				e.commandLine = e.commandLine[:0]
+				_, _ = io.WriteString(e.out, "\r\nssh> ")
+				continue
+			case '?':
+				e.print(string(e.char) + "?")
+				e.print(fmt.Sprintf(escapeHelp, e.char))
+				continue
+			case e.char:
+				// send the escape character once
+				out.WriteByte(b)
+				e.afterNewline = false
+				continue
+			default:
+				// not an escape sequence, send both
+				out.WriteByte(e.char)
+			}
+		} else if e.afterNewline && b == e.char {
+			e.pending = true
+			continue
+		}
+
+		out.WriteByte(b)
+		e.afterNewline = b == '\r' || b == '\n'
+	}
+	return out.Bytes()
+}
+
+// read the command line, the terminal is in raw mode so echo is done here
+func (e *escapeHandler) commandInput(b byte) {
+	switch b {
+	case '\r', '\n':
+		e.inCommand = false
+		_, _ = io.WriteString(e.out, "\r\n")
+		line := strings.TrimSpace(string(e.commandLine))
+		if line != "" && e.command != nil {
+			if msg := e.command(line); msg != "" {
+				e.print(msg)
+			}
+		}
+		// escapes are recognized again after the command line
+		e.afterNewline = true
+	case 0x7f, 0x08:
+		if len(e.commandLine) > 0 {
+			e.commandLine = e.commandLine[:len(e.commandLine)-1]
+			_, _ = io.WriteString(e.out, "\b \b")
+		}
+	case 0x03, 0x15:
+		// ^C and ^U cancel the command line
+		e.inCommand = false
+		e.afterNewline = true
+		_, _ = io.WriteString(e.out, "\r\n")
+	default:
+		if b >= 0x20 {
+			e.commandLine = append(e.commandLine, b)
+			_, _ = e.out.Write([]byte{b})
+		}
+	}
+}
+
+// set the escape character of TerminalWithKeepAlive, default is '~',
+// NoEscape disables escape sequences
+func (s *SSHSession) SetEscapeChar(ch int) {
+	s.escapeChar = ch
+}
+
+// set the connection of the session, it is required by the port forwards
+// of the escape command line and its address is the Host of PipeExec errors
+func (s *SSHSession) SetClient(client *ssh.Client) {
+	s.client = client
+}
+
+// create the escape handler of the terminal, nil if disabled
+func (s *SSHSession) newEscapeHandler(out io.Writer, suspend func()) *escapeHandler {
+	char := s.escapeChar
+	if char == NoEscape {
+		return nil
+	}
+	if char <= 0 || char > 0xff {
+		char = defaultEscapeChar
+	}
+
+	e := newEscapeHandler(byte(char), out)
+	e.disconnect = func() {
+		s.exitMsg = "Connection closed."
+		s.log().Info("disconnect by escape sequence")
+		_ = s.session.Close()
+	}
+	e.suspend = suspend
+	e.command = s.escapeCommand
+	e.list = s.listForwards
+	return e
+}
+
+// run a command of the escape command line
+func (s *SSHSession) escapeCommand(line string) string {
+	if line == "?" || line == "-h" || line == "help" {
+		return escapeCommandHelp
+	}
+
+	var remote, cancel bool
+	switch {
+	case strings.HasPrefix(line, "-KL"):
+		cancel = true
+	case strings.HasPrefix(line, "-KR"):
+		cancel, remote = true, true
+	case strings.HasPrefix(line, "-L"):
+	case strings.HasPrefix(line, "-R"):
+		remote = true
+	default:
+		return "Invalid command."
+	}
+	if cancel {
+		line = line[3:]
+	} else {
+		line = line[2:]
+	}
+	spec := strings.TrimSpace(line)
+
+	if s.client == nil {
+		return "Port forwarding is not available."
+	}
+
+	if cancel {
+		bindAddr, err := parseCancelSpec(spec)
+		if err != nil {
+			return err.Error()
+		}
+		err = s.cancelForward(remote, bindAddr)
+		if err != nil {
+			return err.Error()
+		}
+		return "Canceled forwarding."
+	}
+
+	bindAddr, destAddr, err := parseForwardSpec(spec)
+	if err != nil {
+		return err.Error()
+	}
+	var f *PortForward
+	if remote {
+		f, err = remoteForward(s.client, bindAddr, destAddr, s.logger)
+	} else {
+		f, err = localForward(s.client, bindAddr, destAddr, s.logger)
+	}
+	if err != nil {
+		return "Port forwarding failed: " + err.Error()
+	}
+	s.forwardsMu.Lock()
+	s.forwards = append(s.forwards, f)
+	s.forwardsMu.Unlock()
+	s.log().Info("port forward added", "forward", f.String())
+	return "Forwarding port."
+}
+
+// cancel the forward listening on bindAddr
+func (s *SSHSession) cancelForward(remote bool, bindAddr string) error {
+	s.forwardsMu.Lock()
+	defer s.forwardsMu.Unlock()
+	for i, f := range s.forwards {
+		if f.Remote == remote && f.BindAddr == bindAddr {
+			s.forwards = append(s.forwards[:i], s.forwards[i+1:]...)
+			s.log().Info("port forward canceled", "forward", f.String())
+			return f.Close()
+		}
+	}
+	return errors.New("unknown port forwarding")
+}
+
+// list the forwards and their open connections
+func (s *SSHSession) listForwards() string {
+	s.forwardsMu.Lock()
+	defer s.forwardsMu.Unlock()
+	if len(s.forwards) == 0 {
+		return "No forwarded connections."
+	}
+	msg := "The following connections are open:\n"
+	for i, f := range s.forwards {
+		msg += fmt.Sprintf("  #%d %s (%d connections)\n", i, f.String(), f.Conns())
+	}
+	return msg
+}
+
+// close the forwards added by the escape command line
+func (s *SSHSession) closeForwards() {
+	s.forwardsMu.Lock()
+	defer s.forwardsMu.Unlock()
+	for _, f := range s.forwards {
+		_ = f.Close()
+	}
+	s.forwards = nil
+}
@@ -0,0 +1,148 @@
+package sshutils
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestEscapeFilter(t *testing.T) {
+	tests := []struct {
+		name  string
+		char  byte
+		input []string
+		want  string
+		// calls of the handler functions, in order
+		wantCalls []string
+		// substrings of the local terminal output
+		wantOut []string
+	}{
+		{name: "plain", input: []string{"ls\r"}, want: "ls\r"},
+		{name: "disconnect", input: []string{"~."}, wantCalls: []string{"disconnect"}, wantOut: []string{"~.\r\n"}},
+		{name: "disconnect after newline", input: []string{"ls\r~.rest"}, want: "ls\r", wantCalls: []string{"disconnect"}},
+		{name: "not after newline", input: []string{"a~."}, want: "a~."},
+		{name: "split across reads", input: []string{"a\n~", "."}, want: "a\n", wantCalls: []string{"disconnect"}},
+		{name: "escape twice", input: []string{"~~."}, want: "~."},
+		{name: "unknown sequence", input: []string{"~x"}, want: "~x"},
+		{name: "suspend", input: []string{"~\x1a"}, wantCalls: []string{"suspend"}},
+		{name: "list", input: []string{"~#"}, wantCalls: []string{"list"}, wantOut: []string{"forwards"}},
+		{name: "help", input: []string{"~?"}, wantOut: []string{"~.   - terminate connection"}},
+		{name: "help after help", input: []string{"~?~?"}, wantOut: []string{"~?\r\n"}},
+		{name: "custom char", char: '%', input: []string{"~.\r%."}, want: "~.\r", wantCalls: []string{"disconnect"}},
+		{
+			name:      "command line",
+			input:     []string{"~C", "-L 8080:h", ":80\r", "ls\r"},
+			want:      "ls\r",
+			wantCalls: []string{"command -L 8080:h:80"},
+			wantOut:   []string{"ssh> -L 8080:h:80\r\n", "ok\r\n"},
+		},
+		{name: "command line backspace", input: []string{"~Cab\x7fc\r"}, wantCalls: []string{"command ac"}},
+		{name: "command line cancel", input: []string{"~Cab\x03~."}, wantCalls: []string{"disconnect"}},
+		{name: "empty command line", input: []string{"~C\r~."}, wantCalls: []string{"disconnect"}},
+	}
+	for _, tt := range tests {
+		char := tt.char
+		if char == 0 {
+			char = defaultEscapeChar
+		}
+		var out bytes.Buffer
+		var calls []string
+		e := newEscapeHandler(char, &out)
+		e.disconnect = func() { calls = append(calls, "disconnect") }
+		e.suspend = func() { calls = append(calls, "suspend") }
+		e.list = func() string {
+			calls = append(calls, "list")
+			return "forwards"
+		}
+		e.command = func(line string) string {
+			calls = append(calls, "command "+line)
+			return "ok"
+		}
+
+		var sent []byte
+		for _, in := range tt.input {
+			sent = append(sent, e.filter([]byte(in))...)
+			if e.disconnected {
+				break
+			}
+		}
+		if string(sent) != tt.want {
+			t.Errorf("%s: sent %q, want %q", tt.name, sent, tt.want)
+		}
+		if strings.Join(calls, ",") != strings.Join(tt.wantCalls, ",") {
+			t.Errorf("%s: calls %q, want %q", tt.name, calls, tt.wantCalls)
+		}
+		for _, s := range tt.wantOut {
+			if !strings.Contains(out.String(), s) {
+				t.Errorf("%s: output %q does not contain %q", tt.name, out.String(), s)
+			}
+		}
+	}
+}
+
+func TestEscapeSuspendUnsupported(t *testing.T) {
+	var out bytes.Buffer
+	e := newEscapeHandler(defaultEscapeChar, &out)
+	if sent := e.filter([]byte("~\x1a")); len(sent) != 0 {
+		t.Errorf("sent %q", sent)
+	}
+	if !strings.Contains(out.String(), "not supported") {
+		t.Errorf("output %q", out.String())
+	}
+}
+
+func TestParseForwardSpec(t *testing.T) {
+	tests := []struct {
+		spec     string
+		bindAddr string
+		destAddr string
+		wantErr  bool
+	}{
+		{spec: "8080:example.com:80", bindAddr: "localhost:8080", destAddr: "example.com:80"},
+		{spec: "0.0.0.0:8080:10.0.0.1:80", bindAddr: "0.0.0.0:8080", destAddr: "10.0.0.1:80"},
+		{spec: ":8080:h:80", bindAddr: ":8080", destAddr: "h:80"},
+		{spec: "8080:h", wantErr: true},
+		{spec: "a:b:c:d:e", wantErr: true},
+		{spec: "x:h:80", wantErr: true},
+		{spec: "8080:h:65536", wantErr: true},
+	}
+	for _, tt := range tests {
+		bindAddr, destAddr, err := parseForwardSpec(tt.spec)
+		if tt.wantErr {
+			if !errors.Is(err, ErrInvalidParameter) {
+				t.Errorf("%q: error %v, want ErrInvalidParameter", tt.spec, err)
+			}
+			continue
+		}
+		if err != nil || bindAddr != tt.bindAddr || destAddr != tt.destAddr {
+			t.Errorf("%q: got %q, %q, %v, want %q, %q", tt.spec, bindAddr, destAddr, err, tt.bindAddr, tt.destAddr)
+		}
+	}
+}
+
+func TestParseCancelSpec(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    string
+		wantErr bool
+	}{
+		{spec: "8080", want: "localhost:8080"},
+		{spec: "127.0.0.1:8080", want: "127.0.0.1:8080"},
+		{spec: "[::1]:8080", want: "[::1]:8080"},
+		{spec: "", wantErr: true},
+		{spec: "host:port", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseCancelSpec(tt.spec)
+		if tt.wantErr {
+			if !errors.Is(err, ErrInvalidParameter) {
+				t.Errorf("%q: error %v, want ErrInvalidParameter", tt.spec, err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%q: got %q, %v, want %q", tt.spec, got, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,540 @@
+package sshutils
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// marker printed before every section of the facts script
+const factsMarker = "[sshutils-facts] "
+
+// the facts script, it only uses POSIX sh and commands available on
+// BusyBox, BSD and macOS; every section degrades to empty output
+var factsScript = strings.Join([]string{
+	`m() { echo; echo '` + factsMarker + `'"$1"; }`,
+	`m hostname; hostname 2>/dev/null || uname -n 2>/dev/null || cat /etc/hostname 2>/dev/null`,
+	`m uname; uname -s 2>/dev/null; uname -r 2>/dev/null; uname -m 2>/dev/null; uname -v 2>/dev/null`,
+	`m os-release; cat /etc/os-release 2>/dev/null || cat /usr/lib/os-release 2>/dev/null`,
+	`m sw_vers; sw_vers 2>/dev/null`,
+	`m cpus; getconf _NPROCESSORS_ONLN 2>/dev/null || nproc 2>/dev/null || grep -c '^processor' /proc/cpuinfo 2>/dev/null || sysctl -n hw.ncpu 2>/dev/null`,
+	`m meminfo; cat /proc/meminfo 2>/dev/null`,
+	`m physmem; sysctl -n hw.memsize 2>/dev/null || sysctl -n hw.physmem 2>/dev/null`,
+	`m mounts; cat /proc/mounts 2>/dev/null || mount 2>/dev/null`,
+	`m df; df -kP 2>/dev/null || df -k 2>/dev/null`,
+	`m ips; ip -o addr show 2>/dev/null || ifconfig -a 2>/dev/null || hostname -I 2>/dev/null`,
+	`m init; echo "comm=$(cat /proc/1/comm 2>/dev/null)"; echo "link=$(readlink /sbin/init 2>/dev/null)"; ` +
+		`[ -d /run/systemd/system ] && echo systemd; [ -x /sbin/openrc ] || [ -x /sbin/openrc-run ] && echo openrc; ` +
+		`initctl version 2>/dev/null | grep -q upstart && echo upstart; [ -d /etc/runit ] && echo runit`,
+	`m pkg; for p in apt-get dnf yum zypper pacman apk emerge xbps-install opkg pkg pkg_add brew port; do command -v $p >/dev/null 2>&1 && echo $p; done`,
+	`exit 0`,
+}, "\n")
+
+// package manager names of the commands
+var packageManagers = map[string]string{
+	"apt-get":      "apt",
+	"xbps-install": "xbps",
+}
+
+var (
+	// inet addresses of `ip -o addr` and ifconfig
+	inetRe = regexp.MustCompile(`inet6?\s+(?:addr:\s*)?([0-9a-fA-F.:]+)`)
+	// `mount` output of Linux and BusyBox
+	mountLinuxRe = regexp.MustCompile(`^(\S+) on (.+) type (\S+) \((.*)\)$`)
+	// `mount` output of BSD and macOS
+	mountBSDRe = regexp.MustCompile(`^(\S+) on (.+) \(([^,]+)(?:, (.*))?\)$`)
+)
+
+// Facts is the profile of a host, facts which can not be gathered are
+// zero and listed in Unavailable
+type Facts struct {
+	Hostname string       `json:"hostname"`
+	OS       OSFacts      `json:"os"`
+	Kernel   KernelFacts  `json:"kernel"`
+	CPUs     int          `json:"cpus"`
+	Memory   MemoryFacts  `json:"memory"`
+	Mounts   []MountFacts `json:"mounts"`
+	Disks    []DiskFacts  `json:"disks"`
+	// addresses of all interfaces except loopback
+	IPs []string `json:"ips"`
+	// systemd, openrc, upstart, runit, busybox, sysvinit, launchd or bsdinit
+	InitSystem string `json:"init_system"`
+	// apt, dnf, yum, zypper, pacman, apk, emerge, xbps, opkg, pkg, pkg_add, brew or port
+	PackageManager string    `json:"package_manager"`
+	Unavailable    []string  `json:"unavailable,omitempty"`
+	GatheredAt     time.Time `json:"gathered_at"`
+}
+
+// OSFacts is the operating system, from /etc/os-release or sw_vers
+type OSFacts struct {
+	// e.g. "ubuntu", "alpine", "macos", "freebsd"
+	ID         string   `json:"id"`
+	IDLike     []string `json:"id_like,omitempty"`
+	Name       string   `json:"name"`
+	Version    string   `json:"version,omitempty"`
+	VersionID  string   `json:"version_id,omitempty"`
+	PrettyName string   `json:"pretty_name,omitempty"`
+}
+
+// KernelFacts is the output of uname
+type KernelFacts struct {
+	// e.g. "Linux", "Darwin", "FreeBSD"
+	Name    string `json:"name"`
+	Release string `json:"release"`
+	Version string `json:"version"`
+	// machine hardware name, e.g. "x86_64", "aarch64", "arm64"
+	Arch string `json:"arch"`
+}
+
+// MemoryFacts is the memory in bytes, only the total is known on non-Linux hosts
+type MemoryFacts struct {
+	TotalBytes     uint64 `json:"total_bytes"`
+	AvailableBytes uint64 `json:"available_bytes,omitempty"`
+	SwapTotalBytes uint64 `json:"swap_total_bytes,omitempty"`
+	SwapFreeBytes  uint64 `json:"swap_free_bytes,omitempty"`
+}
+
+// MountFacts is a mounted filesystem
+type MountFacts struct {
+	Device     string   `json:"device"`
+	MountPoint string   `json:"mount_point"`
+	FSType     string   `json:"fs_type"`
+	Options    []string `json:"options,omitempty"`
+}
+
+// DiskFacts is the usage of a filesystem reported by df
+type DiskFacts struct {
+	Filesystem     string `json:"filesystem"`
+	MountPoint     string `json:"mount_point"`
+	TotalBytes     uint64 `json:"total_bytes"`
+	UsedBytes      uint64 `json:"used_bytes"`
+	AvailableBytes uint64 `json:"available_bytes"`
+}
+
+// JSON returns the facts as indented JSON
+func (f *Facts) JSON() ([]byte, error) {
+	return json.MarshalIndent(f, "", "  ")
+}
+
+// GatherFacts collects the facts of the host by a single command, missing
+// commands and files do not fail
+func GatherFacts(client *ssh.Client) (*Facts, error) {
+	// the script is fed by stdin, csh parses a multi-line argument as unmatched quotes
+	cmd := NewCommand(client, "sh", "-s")
+	cmd.Stdin = strings.NewReader(factsScript)
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+	return parseFacts(splitFactsSections(string(out))), nil
+}
+
+// split the script output by the section markers
+func splitFactsSections(out string) map[string]string {
+	sections := make(map[string]string)
+	var name string
+	var lines []string
+	flush := func() {
+		if name != "" {
+			sections[name] = strings.TrimSpace(strings.Join(lines, "\n"))
+		}
+	}
+	for _, line := range strings.Split(out, "\n") {
+		if strings.HasPrefix(line, factsMarker) {
+			flush()
+			name, lines = strings.TrimPrefix(line, factsMarker), nil
+			continue
+		}
+		lines = append(lines, line)
+	}
+	flush()
+	return sections
+}
+
+func parseFacts(sections map[string]string) *Facts {
+	f := &Facts{GatheredAt: time.Now()}
+
+	f.Hostname = firstLine(sections["hostname"])
+
+	uname := strings.Split(sections["uname"], "\n")
+	if len(uname) >= 3 {
+		f.Kernel = KernelFacts{Name: uname[0], Release: uname[1], Arch: uname[2]}
+		if len(uname) >= 4 {
+			f.Kernel.Version = uname[3]
+		}
+	}
+
+	f.OS = parseOSRelease(sections["os-release"])
+	if f.OS.ID == "" {
+		f.OS = parseSwVers(sections["sw_vers"])
+	}
+	if f.OS.ID == "" && f.Kernel.Name != "" {
+		// e.g. old BSD without os-release
+		f.OS = OSFacts{ID: strings.ToLower(f.Kernel.Name), Name: f.Kernel.Name, VersionID: f.Kernel.Release}
+	}
+
+	f.CPUs, _ = strconv.Atoi(firstLine(sections["cpus"]))
+	f.Memory = parseMeminfo(sections["meminfo"])
+	if f.Memory.TotalBytes == 0 {
+		f.Memory.TotalBytes, _ = strconv.ParseUint(firstLine(sections["physmem"]), 10, 64)
+	}
+	f.Mounts = parseMounts(sections["mounts"])
+	f.Disks = parseDf(sections["df"])
+	f.IPs = parseIPs(sections["ips"])
+	f.InitSystem = parseInitSystem(sections["init"], f.Kernel.Name)
+	if pm := firstLine(sections["pkg"]); pm != "" {
+		f.PackageManager = pm
+		if name, ok := packageManagers[pm]; ok {
+			f.PackageManager = name
+		}
+	}
+
+	for _, fact := range []struct {
+		name    string
+		missing bool
+	}{
+		{"hostname", f.Hostname == ""},
+		{"kernel", f.Kernel.Name == ""},
+		{"os", f.OS.ID == ""},
+		{"cpus", f.CPUs == 0},
+		{"memory", f.Memory.TotalBytes == 0},
+		{"mounts", len(f.Mounts) == 0},
+		{"disks", len(f.Disks) == 0},
+		{"ips", len(f.IPs) == 0},
+		{"init_system", f.InitSystem == ""},
+		{"package_manager", f.PackageManager == ""},
+	} {
+		if fact.missing {
+			f.Unavailable = append(f.Unavailable, fact.name)
+		}
+	}
+	return f
+}
+
+func firstLine(s string) string {
+	if i := strings.IndexByte(s, '\n'); i >= 0 {
+		s = s[:i]
+	}
+	return strings.TrimSpace(s)
+}
+
+// parse the KEY=value lines of os-release, values may be shell quoted
+func parseOSRelease(s string) OSFacts {
+	var osFacts OSFacts
+	for _, line := range strings.Split(s, "\n") {
+		kv := strings.SplitN(strings.TrimSpace(line), "=", 2)
+		if len(kv) != 2 || strings.HasPrefix(kv[0], "#") {
+			continue
+		}
+		value := kv[1]
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			quote := value[0]
+			value = value[1 : len(value)-1]
+			if quote == '"' {
+				value = strings.NewReplacer(`\"`, `"`, `\\`, `\`, `\$`, `$`, "\\`", "`").Replace(value)
+			}
+		}
+		switch kv[0] {
+		case "ID":
+			osFacts.ID = value
+		case "ID_LIKE":
+			osFacts.IDLike = strings.Fields(value)
+		case "NAME":
+			osFacts.Name = value
+		case "VERSION":
+			osFacts.Version = value
+		case "VERSION_ID":
+			osFacts.VersionID = value
+		case "PRETTY_NAME":
+			osFacts.PrettyName = value
+		}
+	}
+	return osFacts
+}
+
+// parse the `Key: value` lines of macOS sw_vers
+func parseSwVers(s string) OSFacts {
+	var osFacts OSFacts
+	for _, line := range strings.Split(s, "\n") {
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		value := strings.TrimSpace(kv[1])
+		switch strings.TrimSpace(kv[0]) {
+		case "ProductName":
+			osFacts.Name = value
+		case "ProductVersion":
+			osFacts.VersionID = value
+		case "BuildVersion":
+			osFacts.Version = value
+		}
+	}
+	if osFacts.Name != "" {
+		osFacts.ID = "macos"
+		osFacts.PrettyName = strings.TrimSpace(osFacts.Name + " " + osFacts.VersionID)
+	}
+	return osFacts
+}
+
+// parse /proc/meminfo, the values are in kB
+func parseMeminfo(s string) MemoryFacts {
+	var mem MemoryFacts
+	var free, buffers, cached uint64
+	for _, line := range strings.Split(s, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		n, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		n *= 1024
+		switch strings.TrimSuffix(fields[0], ":") {
+		case "MemTotal":
+			mem.TotalBytes = n
+		case "MemAvailable":
+			mem.AvailableBytes = n
+		case "MemFree":
+			free = n
+		case "Buffers":
+			buffers = n
+		case "Cached":
+			cached = n
+		case "SwapTotal":
+			mem.SwapTotalBytes = n
+		case "SwapFree":
+			mem.SwapFreeBytes = n
+		}
+	}
+	// MemAvailable is missing before Linux 3.14
+	if mem.AvailableBytes == 0 {
+		mem.AvailableBytes = free + buffers + cached
+	}
+	return mem
+}
+
+// parse /proc/mounts or the output of mount
+func parseMounts(s string) []MountFacts {
+	var mounts []MountFacts
+	for _, line := range strings.Split(s, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if m := mountLinuxRe.FindStringSubmatch(line); m != nil {
+			mounts = append(mounts, MountFacts{Device: m[1], MountPoint: m[2], FSType: m[3], Options: splitOptions(m[4], ",")})
+			continue
+		}
+		if m := mountBSDRe.FindStringSubmatch(line); m != nil {
+			mounts = append(mounts, MountFacts{Device: m[1], MountPoint: m[2], FSType: m[3], Options: splitOptions(m[4], ", ")})
+			continue
+		}
+		// /proc/mounts, spaces are escaped as \040
+		fields := strings.Fields(line)
+		if len(fields) < 4 {
+			continue
+		}
+		mounts = append(mounts, MountFacts{
+			Device:     unescapeMount(fields[0]),
+			MountPoint: unescapeMount(fields[1]),
+			FSType:     fields[2],
+			Options:    splitOptions(fields[3], ","),
+		})
+	}
+	return mounts
+}
+
+func splitOptions(s, sep string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, sep)
+}
+
+// unescape the octal escapes of /proc/mounts
+func unescapeMount(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// parse the output of `df -kP`, long filesystem names may wrap without -P
+func parseDf(s string) []DiskFacts {
+	var disks []DiskFacts
+	var pending []string
+	scanner := bufio.NewScanner(strings.NewReader(s))
+	for header := true; scanner.Scan(); {
+		if header {
+			header = false
+			continue
+		}
+		fields := append(pending, strings.Fields(scanner.Text())...)
+		if len(fields) < 6 {
+			pending = fields
+			continue
+		}
+		pending = nil
+
+		total, err1 := strconv.ParseUint(fields[1], 10, 64)
+		used, err2 := strconv.ParseUint(fields[2], 10, 64)
+		avail, err3 := strconv.ParseUint(fields[3], 10, 64)
+		if err1 != nil || err2 != nil || err3 != nil {
+			continue
+		}
+		disks = append(disks, DiskFacts{
+			Filesystem:     fields[0],
+			MountPoint:     strings.Join(fields[5:], " "),
+			TotalBytes:     total * 1024,
+			UsedBytes:      used * 1024,
+			AvailableBytes: avail * 1024,
+		})
+	}
+	return disks
+}
+
+// parse the addresses of `ip -o addr`, ifconfig or `hostname -I`
+func parseIPs(s string) []string {
+	var candidates []string
+	if strings.Contains(s, "inet") {
+		for _, m := range inetRe.FindAllStringSubmatch(s, -1) {
+			candidates = append(candidates, m[1])
+		}
+	} else {
+		candidates = strings.Fields(s)
+	}
+
+	var ips []string
+	seen := make(map[string]bool)
+	for _, c := range candidates {
+		ip := net.ParseIP(c)
+		if ip == nil || ip.IsLoopback() || seen[ip.String()] {
+			continue
+		}
+		seen[ip.String()] = true
+		ips = append(ips, ip.String())
+	}
+	return ips
+}
+
+// detect the init system from the init section and the kernel name
+func parseInitSystem(s, kernel string) string {
+	var comm, link string
+	found := make(map[string]bool)
+	for _, line := range strings.Split(s, "\n") {
+		switch {
+		case strings.HasPrefix(line, "comm="):
+			comm = strings.TrimPrefix(line, "comm=")
+		case strings.HasPrefix(line, "link="):
+			link = strings.TrimPrefix(line, "link=")
+		default:
+			found[strings.TrimSpace(line)] = true
+		}
+	}
+
+	switch {
+	case found["systemd"] || comm == "systemd":
+		return "systemd"
+	case found["openrc"]:
+		return "openrc"
+	case found["upstart"]:
+		return "upstart"
+	case comm == "runit" || found["runit"]:
+		return "runit"
+	case strings.Contains(link, "busybox"):
+		return "busybox"
+	case comm == "init":
+		return "sysvinit"
+	case kernel == "Darwin":
+		return "launchd"
+	case strings.HasSuffix(kernel, "BSD") || kernel == "DragonFly":
+		return "bsdinit"
+	}
+	return ""
+}
+
+// FactsCache caches the facts per host and user, it is safe for
+// concurrent use and gathers the facts of a host once at a time
+type FactsCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*factsEntry
+}
+
+type factsEntry struct {
+	done  chan struct{}
+	facts *Facts
+	err   error
+}
+
+// NewFactsCache creates a cache whose facts expire after ttl, 0 never expires
+func NewFactsCache(ttl time.Duration) *FactsCache {
+	return &FactsCache{ttl: ttl, entries: make(map[string]*factsEntry)}
+}
+
+// cache key of the connection
+func factsKey(client *ssh.Client) string {
+	addr := client.RemoteAddr()
+	return poolKey(addr.Network(), addr.String(), client.User())
+}
+
+// Get returns the cached facts of the host, they are gathered if missing
+// or expired; errors are not cached
+func (c *FactsCache) Get(client *ssh.Client) (*Facts, error) {
+	key := factsKey(client)
+	for {
+		c.mu.Lock()
+		e, ok := c.entries[key]
+		if !ok {
+			break
+		}
+		c.mu.Unlock()
+
+		<-e.done
+		if e.err == nil && (c.ttl <= 0 || time.Since(e.facts.GatheredAt) < c.ttl) {
+			return e.facts, nil
+		}
+		// failed or expired, gather again unless another caller started it
+		c.mu.Lock()
+		if c.entries[key] == e {
+			delete(c.entries, key)
+		}
+		c.mu.Unlock()
+	}
+
+	e := &factsEntry{done: make(chan struct{})}
+	c.entries[key] = e
+	c.mu.Unlock()
+
+	e.facts, e.err = GatherFacts(client)
+	close(e.done)
+	return e.facts, e.err
+}
+
+// Invalidate removes the cached facts of the host
+func (c *FactsCache) Invalidate(client *ssh.Client) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, factsKey(client))
+}
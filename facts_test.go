@@ -0,0 +1,266 @@
+package sshutils
+
+import (
+	"os/exec"
+	"reflect"
+	"testing"
+)
+
+func TestParseOSRelease(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want OSFacts
+	}{
+		{
+			name: "ubuntu",
+			in: `NAME="Ubuntu"
+VERSION="20.04.2 LTS (Focal Fossa)"
+ID=ubuntu
+ID_LIKE=debian
+PRETTY_NAME="Ubuntu 20.04.2 LTS"
+VERSION_ID="20.04"`,
+			want: OSFacts{ID: "ubuntu", IDLike: []string{"debian"}, Name: "Ubuntu", Version: "20.04.2 LTS (Focal Fossa)", VersionID: "20.04", PrettyName: "Ubuntu 20.04.2 LTS"},
+		},
+		{
+			name: "quoting",
+			in:   "# comment\nID='rhel'\nID_LIKE=\"fedora  centos\"\nNAME=\"A \\\"B\\\" \\$C\"\n  VERSION_ID=8\nbroken",
+			want: OSFacts{ID: "rhel", IDLike: []string{"fedora", "centos"}, Name: `A "B" $C`, VersionID: "8"},
+		},
+		{name: "empty", in: "", want: OSFacts{}},
+	}
+	for _, tt := range tests {
+		if got := parseOSRelease(tt.in); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseSwVers(t *testing.T) {
+	tests := []struct {
+		in   string
+		want OSFacts
+	}{
+		{
+			in:   "ProductName:\tmacOS\nProductVersion:\t11.4\nBuildVersion:\t20F71",
+			want: OSFacts{ID: "macos", Name: "macOS", Version: "20F71", VersionID: "11.4", PrettyName: "macOS 11.4"},
+		},
+		{in: "sw_vers: not found", want: OSFacts{}},
+	}
+	for _, tt := range tests {
+		if got := parseSwVers(tt.in); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: got %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestParseMeminfo(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want MemoryFacts
+	}{
+		{
+			name: "available",
+			in:   "MemTotal:       2000 kB\nMemFree:         100 kB\nMemAvailable:    500 kB\nSwapTotal:      1000 kB\nSwapFree:        900 kB",
+			want: MemoryFacts{TotalBytes: 2000 * 1024, AvailableBytes: 500 * 1024, SwapTotalBytes: 1000 * 1024, SwapFreeBytes: 900 * 1024},
+		},
+		{
+			name: "old kernel",
+			in:   "MemTotal: 2000 kB\nMemFree: 100 kB\nBuffers: 20 kB\nCached: 300 kB\nHugePages_Total: x",
+			want: MemoryFacts{TotalBytes: 2000 * 1024, AvailableBytes: 420 * 1024},
+		},
+		{name: "empty", in: "", want: MemoryFacts{}},
+	}
+	for _, tt := range tests {
+		if got := parseMeminfo(tt.in); got != tt.want {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseMounts(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want []MountFacts
+	}{
+		{
+			name: "proc mounts",
+			in:   "/dev/sda1 / ext4 rw,relatime 0 0\n/dev/sdb1 /mnt/my\\040disk vfat rw 0 0\n\nshort line",
+			want: []MountFacts{
+				{Device: "/dev/sda1", MountPoint: "/", FSType: "ext4", Options: []string{"rw", "relatime"}},
+				{Device: "/dev/sdb1", MountPoint: "/mnt/my disk", FSType: "vfat", Options: []string{"rw"}},
+			},
+		},
+		{
+			name: "linux mount",
+			in:   "/dev/sda1 on /my disk type ext4 (rw,relatime)",
+			want: []MountFacts{{Device: "/dev/sda1", MountPoint: "/my disk", FSType: "ext4", Options: []string{"rw", "relatime"}}},
+		},
+		{
+			name: "bsd mount",
+			in:   "/dev/disk1s1 on / (apfs, local, journaled)\ndevfs on /dev (devfs)",
+			want: []MountFacts{
+				{Device: "/dev/disk1s1", MountPoint: "/", FSType: "apfs", Options: []string{"local", "journaled"}},
+				{Device: "devfs", MountPoint: "/dev", FSType: "devfs"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		if got := parseMounts(tt.in); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestUnescapeMount(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{`/plain`, `/plain`},
+		{`/a\040b`, `/a b`},
+		{`/tab\011x\134`, "/tab\tx\\"},
+		{`/bad\09x`, `/bad\09x`},
+		{`/end\04`, `/end\04`},
+	}
+	for _, tt := range tests {
+		if got := unescapeMount(tt.in); got != tt.want {
+			t.Errorf("unescapeMount(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestParseDf(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want []DiskFacts
+	}{
+		{
+			name: "posix",
+			in: `Filesystem     1024-blocks    Used Available Capacity Mounted on
+/dev/sda1         100      40        60      40% /
+tmpfs              10       0        10       0% /my mnt`,
+			want: []DiskFacts{
+				{Filesystem: "/dev/sda1", MountPoint: "/", TotalBytes: 100 * 1024, UsedBytes: 40 * 1024, AvailableBytes: 60 * 1024},
+				{Filesystem: "tmpfs", MountPoint: "/my mnt", TotalBytes: 10 * 1024, AvailableBytes: 10 * 1024},
+			},
+		},
+		{
+			name: "wrapped",
+			in: `Filesystem 1K-blocks Used Available Use% Mounted on
+/dev/mapper/very-long-volume-name
+                 100      40        60  40% /data
+bad x y z 1% /bad`,
+			want: []DiskFacts{{Filesystem: "/dev/mapper/very-long-volume-name", MountPoint: "/data", TotalBytes: 100 * 1024, UsedBytes: 40 * 1024, AvailableBytes: 60 * 1024}},
+		},
+		{name: "empty", in: ""},
+	}
+	for _, tt := range tests {
+		if got := parseDf(tt.in); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseIPs(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want []string
+	}{
+		{
+			name: "ip",
+			in: `1: lo    inet 127.0.0.1/8 scope host lo\       valid_lft forever preferred_lft forever
+2: eth0    inet 10.0.0.2/24 brd 10.0.0.255 scope global eth0
+2: eth0    inet6 fe80::1/64 scope link
+1: lo    inet6 ::1/128 scope host`,
+			want: []string{"10.0.0.2", "fe80::1"},
+		},
+		{
+			name: "ifconfig",
+			in: `eth0      Link encap:Ethernet
+          inet addr:10.0.0.3  Bcast:10.0.0.255  Mask:255.255.255.0
+en0: flags=8863<UP> mtu 1500
+	inet 192.168.1.2 netmask 0xffffff00 broadcast 192.168.1.255
+	inet 10.0.0.3 netmask 0xffffff00`,
+			want: []string{"10.0.0.3", "192.168.1.2"},
+		},
+		{name: "hostname", in: "10.0.0.4 fd00::4 ", want: []string{"10.0.0.4", "fd00::4"}},
+		{name: "empty", in: ""},
+	}
+	for _, tt := range tests {
+		if got := parseIPs(tt.in); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseInitSystem(t *testing.T) {
+	tests := []struct {
+		in, kernel, want string
+	}{
+		{"comm=systemd\nlink=\nsystemd", "Linux", "systemd"},
+		{"comm=init\nlink=/lib/systemd/systemd\nsystemd", "Linux", "systemd"},
+		{"comm=init\nlink=\nopenrc", "Linux", "openrc"},
+		{"comm=init\nlink=\nupstart", "Linux", "upstart"},
+		{"comm=runit\nlink=", "Linux", "runit"},
+		{"comm=init\nlink=/bin/busybox", "Linux", "busybox"},
+		{"comm=init\nlink=", "Linux", "sysvinit"},
+		{"comm=\nlink=", "Darwin", "launchd"},
+		{"comm=\nlink=", "FreeBSD", "bsdinit"},
+		{"comm=\nlink=", "DragonFly", "bsdinit"},
+		{"comm=\nlink=", "Linux", ""},
+	}
+	for _, tt := range tests {
+		if got := parseInitSystem(tt.in, tt.kernel); got != tt.want {
+			t.Errorf("%q on %s: got %q, want %q", tt.in, tt.kernel, got, tt.want)
+		}
+	}
+}
+
+func TestParseFacts(t *testing.T) {
+	out := "\n" + factsMarker + "hostname\nweb1\n" +
+		factsMarker + "uname\nFreeBSD\n13.0-RELEASE\namd64\n" +
+		factsMarker + "os-release\n" +
+		factsMarker + "sw_vers\n" +
+		factsMarker + "cpus\n4\n" +
+		factsMarker + "meminfo\n" +
+		factsMarker + "physmem\n8589934592\n" +
+		factsMarker + "pkg\npkg\nbrew\n"
+	f := parseFacts(splitFactsSections(out))
+	f.GatheredAt = f.GatheredAt.UTC()
+	want := &Facts{
+		Hostname:       "web1",
+		OS:             OSFacts{ID: "freebsd", Name: "FreeBSD", VersionID: "13.0-RELEASE"},
+		Kernel:         KernelFacts{Name: "FreeBSD", Release: "13.0-RELEASE", Arch: "amd64"},
+		CPUs:           4,
+		Memory:         MemoryFacts{TotalBytes: 8589934592},
+		InitSystem:     "bsdinit",
+		PackageManager: "pkg",
+		Unavailable:    []string{"mounts", "disks", "ips"},
+		GatheredAt:     f.GatheredAt,
+	}
+	if !reflect.DeepEqual(f, want) {
+		t.Errorf("got %+v\nwant %+v", f, want)
+	}
+
+	f = parseFacts(splitFactsSections(factsMarker + "pkg\napt-get\n"))
+	if f.PackageManager != "apt" {
+		t.Errorf("package manager %q, want apt", f.PackageManager)
+	}
+}
+
+func TestGatherFacts(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh not found")
+	}
+	f, err := GatherFacts(newTestSSHClient(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Hostname == "" || f.Kernel.Name == "" || f.CPUs == 0 {
+		t.Errorf("missing facts: %+v", f)
+	}
+}
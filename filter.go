@@ -0,0 +1,46 @@
+package sshutils
+
+import (
+	"path"
+)
+
+// SetExclude skips files and directories whose name or path relative to the
+// copied directory matches any of the patterns (path.Match syntax)
+func (s *scpClient) SetExclude(patterns ...string) {
+	s.exclude = patterns
+}
+
+// SetInclude only copies files whose name or relative path matches any of the
+// patterns, directories are always traversed, no pattern means all files
+func (s *scpClient) SetInclude(patterns ...string) {
+	s.include = patterns
+}
+
+// SetPreserve preserves the modification time of copied files, mode is always preserved
+func (s *scpClient) SetPreserve(preserve bool) {
+	s.preserve = preserve
+}
+
+// check the relative slash separated path should be skipped
+func (s *scpClient) skipped(relPath string, isDir bool) bool {
+	if matchAny(s.exclude, relPath) {
+		return true
+	}
+	if isDir || len(s.include) == 0 {
+		return false
+	}
+	return !matchAny(s.include, relPath)
+}
+
+// check name or relative path matches any pattern
+func matchAny(patterns []string, relPath string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, path.Base(relPath)); ok {
+			return true
+		}
+		if ok, _ := path.Match(p, relPath); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,157 @@
+package sshutils
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// PortForward is a local (-L) or remote (-R) port forward
+type PortForward struct {
+	// true for remote forward
+	Remote bool
+	// listen address, local for local forward and remote for remote forward
+	BindAddr string
+	// destination address, remote for local forward and local for remote forward
+	DestAddr string
+
+	listener net.Listener
+	mu       sync.Mutex
+	conns    int
+}
+
+func (f *PortForward) String() string {
+	if f.Remote {
+		return "remote forward " + f.BindAddr + " -> " + f.DestAddr
+	}
+	return "local forward " + f.BindAddr + " -> " + f.DestAddr
+}
+
+// Conns returns the number of open forwarded connections
+func (f *PortForward) Conns() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.conns
+}
+
+// Close stops listening, open forwarded connections are not closed
+func (f *PortForward) Close() error {
+	return f.listener.Close()
+}
+
+// accept connections and forward them to dial
+func (f *PortForward) serve(dial func() (net.Conn, error), log Logger) {
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer func() {
+				_ = conn.Close()
+			}()
+			dest, err := dial()
+			if err != nil {
+				log.Warn("forward dial failed", "forward", f.String(), "error", err)
+				return
+			}
+			defer func() {
+				_ = dest.Close()
+			}()
+
+			f.mu.Lock()
+			f.conns++
+			f.mu.Unlock()
+			defer func() {
+				f.mu.Lock()
+				f.conns--
+				f.mu.Unlock()
+			}()
+
+			done := make(chan struct{}, 2)
+			go func() {
+				_, _ = io.Copy(dest, conn)
+				done <- struct{}{}
+			}()
+			go func() {
+				_, _ = io.Copy(conn, dest)
+				done <- struct{}{}
+			}()
+			<-done
+		}()
+	}
+}
+
+// LocalForward listens on local bindAddr and forwards connections to
+// destAddr through the connection, like `ssh -L`
+func LocalForward(client *ssh.Client, bindAddr, destAddr string) (*PortForward, error) {
+	return localForward(client, bindAddr, destAddr, nil)
+}
+
+func localForward(client *ssh.Client, bindAddr, destAddr string, logger Logger) (*PortForward, error) {
+	l, err := net.Listen("tcp", bindAddr)
+	if err != nil {
+		return nil, err
+	}
+	f := &PortForward{BindAddr: bindAddr, DestAddr: destAddr, listener: l}
+	go f.serve(func() (net.Conn, error) {
+		return client.Dial("tcp", destAddr)
+	}, loggerOrNop(logger))
+	return f, nil
+}
+
+// RemoteForward listens on remote bindAddr and forwards connections to
+// local destAddr, like `ssh -R`
+func RemoteForward(client *ssh.Client, bindAddr, destAddr string) (*PortForward, error) {
+	return remoteForward(client, bindAddr, destAddr, nil)
+}
+
+func remoteForward(client *ssh.Client, bindAddr, destAddr string, logger Logger) (*PortForward, error) {
+	l, err := client.Listen("tcp", bindAddr)
+	if err != nil {
+		return nil, err
+	}
+	f := &PortForward{Remote: true, BindAddr: bindAddr, DestAddr: destAddr, listener: l}
+	go f.serve(func() (net.Conn, error) {
+		return net.Dial("tcp", destAddr)
+	}, loggerOrNop(logger))
+	return f, nil
+}
+
+// parse the forward spec `[bind_address:]port:host:hostport` of ssh -L/-R
+func parseForwardSpec(spec string) (bindAddr, destAddr string, err error) {
+	parts := strings.Split(spec, ":")
+	if len(parts) != 3 && len(parts) != 4 {
+		return "", "", fmt.Errorf("bad forwarding specification %q: %w", spec, ErrInvalidParameter)
+	}
+	bindHost := "localhost"
+	if len(parts) == 4 {
+		bindHost = parts[0]
+		parts = parts[1:]
+	}
+	for _, port := range []string{parts[0], parts[2]} {
+		if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+			return "", "", fmt.Errorf("bad forwarding port %q: %w", port, ErrInvalidParameter)
+		}
+	}
+	return net.JoinHostPort(bindHost, parts[0]), net.JoinHostPort(parts[1], parts[2]), nil
+}
+
+// parse the cancel spec `[bind_address:]port` of ssh -KL/-KR
+func parseCancelSpec(spec string) (string, error) {
+	bindHost := "localhost"
+	port := spec
+	if i := strings.LastIndex(spec, ":"); i >= 0 {
+		// JoinHostPort adds the brackets of an IPv6 address again
+		bindHost, port = strings.TrimSuffix(strings.TrimPrefix(spec[:i], "["), "]"), spec[i+1:]
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return "", fmt.Errorf("bad forwarding port %q: %w", port, ErrInvalidParameter)
+	}
+	return net.JoinHostPort(bindHost, port), nil
+}
@@ -0,0 +1,158 @@
+package sshutils
+
+import (
+	"path"
+	"sort"
+	"strings"
+)
+
+// Glob returns the remote paths matching pattern, it supports `*`, `?`, `[...]`
+// and `**` (matches zero or more directories), hidden files are only matched
+// when the pattern segment starts with "."
+func (s *scpClient) Glob(pattern string) (paths []string, err error) {
+	defer func() {
+		err = s.wrapError("glob", pattern, true, err)
+	}()
+
+	pattern = s.replaceHome(pattern, false)
+
+	var root string
+	if strings.HasPrefix(pattern, "/") {
+		root = "/"
+	}
+
+	var segs []string
+	for _, seg := range strings.Split(pattern, "/") {
+		if seg != "" && seg != "." {
+			segs = append(segs, seg)
+		}
+	}
+
+	matches := make(map[string]bool)
+	err = s.glob(root, segs, matches)
+	if err != nil {
+		return nil, err
+	}
+
+	for p := range matches {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// match segs under dir recursively
+func (s *scpClient) glob(dir string, segs []string, matches map[string]bool) error {
+	if len(segs) == 0 {
+		matches[dir] = true
+		return nil
+	}
+
+	seg := segs[0]
+
+	// literal segment, no directory listing needed
+	if !hasMeta(seg) {
+		p := path.Join(dir, seg)
+		if len(segs) == 1 {
+			_, err := s.sftpClient.Lstat(p)
+			if err == nil {
+				matches[p] = true
+			}
+			return nil
+		}
+		return s.glob(p, segs[1:], matches)
+	}
+
+	listDir := dir
+	if listDir == "" {
+		listDir = "."
+	}
+	entries, err := s.sftpClient.ReadDir(listDir)
+	if err != nil {
+		// missing or non-directory paths simply do not match
+		if isNotExist(err) {
+			return nil
+		}
+		if info, statErr := s.sftpClient.Stat(listDir); statErr == nil && !info.IsDir() {
+			return nil
+		}
+		return err
+	}
+
+	if seg == "**" {
+		// match zero directories
+		err = s.glob(dir, segs[1:], matches)
+		if err != nil {
+			return err
+		}
+		// match one or more directories
+		for _, e := range entries {
+			if strings.HasPrefix(e.Name(), ".") {
+				continue
+			}
+			if e.IsDir() {
+				err = s.glob(path.Join(dir, e.Name()), segs, matches)
+				if err != nil {
+					return err
+				}
+			} else if len(segs) == 1 {
+				// trailing `**` matches files too
+				matches[path.Join(dir, e.Name())] = true
+			}
+		}
+		return nil
+	}
+
+	for _, e := range entries {
+		// hidden files must be matched explicitly
+		if strings.HasPrefix(e.Name(), ".") && !strings.HasPrefix(seg, ".") {
+			continue
+		}
+		ok, err := path.Match(seg, e.Name())
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		if len(segs) == 1 {
+			matches[path.Join(dir, e.Name())] = true
+		} else if e.IsDir() {
+			err = s.glob(path.Join(dir, e.Name()), segs[1:], matches)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// check the path segment contains glob meta characters
+func hasMeta(seg string) bool {
+	return strings.ContainsAny(seg, `*?[\`)
+}
+
+// expand the glob patterns of the remote paths, a path which exists is
+// not expanded even if it contains meta characters
+func (s *scpClient) expandRemotePaths(patterns []string) ([]string, error) {
+	var remotePaths []string
+	for _, pattern := range patterns {
+		if !hasMeta(pattern) {
+			remotePaths = append(remotePaths, pattern)
+			continue
+		}
+		if _, err := s.sftpClient.Lstat(s.replaceHome(pattern, false)); err == nil {
+			remotePaths = append(remotePaths, pattern)
+			continue
+		}
+		matches, err := s.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		if len(matches) == 0 {
+			return nil, s.pathError("glob", pattern, ErrNoMatch)
+		}
+		remotePaths = append(remotePaths, matches...)
+	}
+	return remotePaths, nil
+}
@@ -0,0 +1,115 @@
+package sshutils
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestGlob(t *testing.T) {
+	s := newTestSCPClient(t)
+	dir, err := ioutil.TempDir("", "sshutils-glob-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	for _, name := range []string{
+		"a.log", "b.txt", ".hidden.log",
+		"x/c.log", "x/y/d.log", "x/y/z/e.log", "x/.h/f.log", ".dot/g.log",
+		"[lit]/h.log",
+	} {
+		p := filepath.Join(dir, name)
+		if err = os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err = ioutil.WriteFile(p, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		pattern string
+		want    []string
+	}{
+		{"*.log", []string{"a.log"}},
+		{".*.log", []string{".hidden.log"}},
+		{"?.txt", []string{"b.txt"}},
+		{"[ab].*", []string{"a.log", "b.txt"}},
+		{"*/c.log", []string{"x/c.log"}},
+		{"**/*.log", []string{"[lit]/h.log", "a.log", "x/c.log", "x/y/d.log", "x/y/z/e.log"}},
+		{"x/**/*.log", []string{"x/c.log", "x/y/d.log", "x/y/z/e.log"}},
+		{"x/**/z/*.log", []string{"x/y/z/e.log"}},
+		{"x/**", []string{"x", "x/c.log", "x/y", "x/y/d.log", "x/y/z", "x/y/z/e.log"}},
+		{"**/y", []string{"x/y"}},
+		{".dot/*", []string{".dot/g.log"}},
+		{"x/.h/*", []string{"x/.h/f.log"}},
+		{"x//./c.log", []string{"x/c.log"}},
+		{"*.none", nil},
+		{"missing/*", nil},
+		{"a.log/*", nil},
+	}
+	for _, tt := range tests {
+		got, err := s.Glob(filepath.Join(dir, tt.pattern))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.pattern, err)
+		}
+		var want []string
+		for _, p := range tt.want {
+			want = append(want, filepath.Join(dir, p))
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %q, want %q", tt.pattern, got, want)
+		}
+	}
+
+	if _, err = s.Glob(filepath.Join(dir, "[")); err == nil {
+		t.Error("bad pattern: no error")
+	}
+}
+
+func TestExpandRemotePaths(t *testing.T) {
+	s := newTestSCPClient(t)
+	dir, err := ioutil.TempDir("", "sshutils-glob-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	for _, name := range []string{"a.log", "b.log", "[lit]"} {
+		if err = ioutil.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		patterns []string
+		want     []string
+		wantErr  error
+	}{
+		{patterns: []string{"missing"}, want: []string{"missing"}},
+		{patterns: []string{"*.log", "[lit]"}, want: []string{"a.log", "b.log", "[lit]"}},
+		{patterns: []string{"a.log", "*.none"}, wantErr: ErrNoMatch},
+	}
+	for _, tt := range tests {
+		var patterns, want []string
+		for _, p := range tt.patterns {
+			patterns = append(patterns, filepath.Join(dir, p))
+		}
+		for _, p := range tt.want {
+			want = append(want, filepath.Join(dir, p))
+		}
+		got, err := s.expandRemotePaths(patterns)
+		if !errors.Is(err, tt.wantErr) {
+			t.Fatalf("%q: error %v, want %v", tt.patterns, err, tt.wantErr)
+		}
+		if err == nil && !reflect.DeepEqual(got, want) {
+			t.Errorf("%q: got %q, want %q", tt.patterns, got, want)
+		}
+	}
+}
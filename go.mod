@@ -3,7 +3,11 @@ module github.com/mritd/sshutils
 go 1.14
 
 require (
+	github.com/cespare/xxhash/v2 v2.1.1
+	github.com/gorilla/websocket v1.4.2
+	github.com/klauspost/compress v1.11.13
 	github.com/mitchellh/go-homedir v1.1.0
-	github.com/pkg/sftp v1.11.0
-	golang.org/x/crypto v0.0.0-20200510223506-06a226fb4e37
+	github.com/pkg/sftp v1.13.0
+	golang.org/x/crypto v0.0.0-20201221181555-eec23a3978ad
+	golang.org/x/sys v0.0.0-20210630005230-0f9fa26af87c
 )
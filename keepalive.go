@@ -0,0 +1,173 @@
+package sshutils
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// default ServerAliveCountMax of OpenSSH
+const defaultServerAliveCountMax = 3
+
+// ErrKeepAliveTimeout means the server did not answer keepalive requests
+var ErrKeepAliveTimeout = errors.New("keepalive timeout")
+
+// KeepAliveError is returned by terminals, exec and copies when the
+// connection was closed because the server stopped answering keepalives
+type KeepAliveError struct {
+	// empty if the host is unknown, e.g. for SSHSession
+	Host     string
+	Interval time.Duration
+	CountMax int
+}
+
+func (e *KeepAliveError) Error() string {
+	msg := fmt.Sprintf("no keepalive reply for %d requests with interval %s", e.CountMax, e.Interval)
+	if e.Host != "" {
+		msg = e.Host + ": " + msg
+	}
+	return msg
+}
+
+func (e *KeepAliveError) Is(target error) bool { return target == ErrKeepAliveTimeout }
+
+// Timeout implements net.Error
+func (e *KeepAliveError) Timeout() bool { return true }
+
+// Temporary implements net.Error
+func (e *KeepAliveError) Temporary() bool { return false }
+
+// KeepAlive sends connection level `keepalive@openssh.com` requests and
+// closes the connection if the server misses CountMax replies in a row
+type KeepAlive struct {
+	interval time.Duration
+	countMax int
+	logger   Logger
+	stopCh   chan struct{}
+	stopOnce sync.Once
+	deadCh   chan struct{}
+
+	mu  sync.Mutex
+	err error
+}
+
+// StartKeepAlive starts keepalive on the connection, countMax <= 0 defaults to 3
+func StartKeepAlive(client *ssh.Client, interval time.Duration, countMax int) *KeepAlive {
+	return StartKeepAliveWithLogger(client, interval, countMax, nil)
+}
+
+// StartKeepAliveWithLogger is StartKeepAlive which emits keepalive failures to logger
+func StartKeepAliveWithLogger(client *ssh.Client, interval time.Duration, countMax int, logger Logger) *KeepAlive {
+	k := startKeepAlive(client.RemoteAddr().String(), interval, countMax, logger, func() error {
+		_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+		return err
+	}, client.Close)
+
+	// stop when the connection is closed by other reasons
+	go func() {
+		_ = client.Wait()
+		k.Stop()
+	}()
+	return k
+}
+
+// start keepalive loop, closeFn is called when the peer is considered dead
+func startKeepAlive(host string, interval time.Duration, countMax int, logger Logger, send func() error, closeFn func() error) *KeepAlive {
+	if countMax <= 0 {
+		countMax = defaultServerAliveCountMax
+	}
+	k := &KeepAlive{
+		interval: interval,
+		countMax: countMax,
+		logger:   loggerOrNop(logger),
+		stopCh:   make(chan struct{}),
+		deadCh:   make(chan struct{}),
+	}
+
+	go keepAliveLoop(interval, countMax, k.stopCh, k.logger, send, func() {
+		k.mu.Lock()
+		k.err = &KeepAliveError{Host: host, Interval: interval, CountMax: countMax}
+		k.mu.Unlock()
+		close(k.deadCh)
+		_ = closeFn()
+	})
+	return k
+}
+
+// Err returns *KeepAliveError if the connection was closed because of dead peer
+func (k *KeepAlive) Err() error {
+	if k == nil {
+		return nil
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.err
+}
+
+// Dead is closed when the peer is considered dead
+func (k *KeepAlive) Dead() <-chan struct{} {
+	return k.deadCh
+}
+
+// Stop stops sending keepalives, the connection is not closed
+func (k *KeepAlive) Stop() {
+	k.stopOnce.Do(func() {
+		close(k.stopCh)
+	})
+}
+
+// replace err with the keepalive error if the peer is dead
+func (k *KeepAlive) wrap(err error) error {
+	if err == nil {
+		return nil
+	}
+	if kaErr := k.Err(); kaErr != nil {
+		return kaErr
+	}
+	return err
+}
+
+// send keepalive every interval until stopCh is closed, a request which is not
+// answered within the interval counts as missed, onDead is called after
+// countMax missed requests in a row
+func keepAliveLoop(interval time.Duration, countMax int, stopCh <-chan struct{}, log Logger, send func() error, onDead func()) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	missed := 0
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+		}
+
+		replyCh := make(chan error, 1)
+		go func() {
+			replyCh <- send()
+		}()
+
+		select {
+		case <-stopCh:
+			return
+		case err := <-replyCh:
+			if err == nil {
+				missed = 0
+				continue
+			}
+			log.Warn("keepalive failed", "error", err)
+		case <-time.After(interval):
+			log.Warn("keepalive timeout", "interval", interval)
+		}
+
+		missed++
+		if missed >= countMax {
+			log.Error("server not responding, closing connection", "missed", missed)
+			onDead()
+			return
+		}
+	}
+}
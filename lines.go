@@ -0,0 +1,244 @@
+package sshutils
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// default max length of a line
+const defaultMaxLineLength = 64 * 1024
+
+// ansi escape sequences: CSI, OSC and two bytes escapes
+var ansiRe = regexp.MustCompile(`\x1b(?:\[[0-?]*[ -/]*[@-~]|\][^\x07\x1b]*(?:\x07|\x1b\\)|[@-Z\\-_])`)
+
+// LineSource is the output stream of a line
+type LineSource int
+
+const (
+	// SourceStdout is the stdout of the command, or the merged output of a pty
+	SourceStdout LineSource = iota
+	// SourceStderr is the stderr of the command
+	SourceStderr
+)
+
+func (s LineSource) String() string {
+	switch s {
+	case SourceStdout:
+		return "stdout"
+	case SourceStderr:
+		return "stderr"
+	default:
+		return "unknown"
+	}
+}
+
+// CRMode is the handling of carriage returns
+type CRMode int
+
+const (
+	// CRStrip removes CR, CRLF ends a line like LF
+	CRStrip CRMode = iota
+	// CRNewline makes CR end a line too, e.g. for progress output
+	CRNewline
+	// CROverwrite keeps the text after the last CR of a line, like a
+	// terminal displays it
+	CROverwrite
+	// CRKeep keeps CR in the text
+	CRKeep
+)
+
+// Line is a line of the command output
+type Line struct {
+	// text without the line terminator
+	Text   string
+	Source LineSource
+	// time the line was terminated
+	Time time.Time
+	// true if the line was not terminated, because the output ended or the
+	// line exceeded MaxLineLength
+	Partial bool
+}
+
+// LineOptions configures a LineProcessor
+type LineOptions struct {
+	CR CRMode
+	// strip ANSI escape sequences, e.g. colors of a pty
+	StripANSI bool
+	// longer lines are split, default 64KiB
+	MaxLineLength int
+}
+
+// LineProcessor splits the output of a command into lines, it is written
+// by its Stdout and Stderr writers, e.g. the streams of Command or the
+// Stdout of PipeExec. The handler is called for every line in order and
+// never concurrently; writes block while it runs, so a slow handler
+// throttles the remote output. An error of the handler is returned by the
+// writes.
+type LineProcessor struct {
+	opts    LineOptions
+	handler func(Line) error
+
+	mu     sync.Mutex
+	err    error
+	stdout *lineWriter
+	stderr *lineWriter
+}
+
+// NewLineProcessor creates a line processor which passes lines to handler
+func NewLineProcessor(opts LineOptions, handler func(Line) error) *LineProcessor {
+	if opts.MaxLineLength <= 0 {
+		opts.MaxLineLength = defaultMaxLineLength
+	}
+	p := &LineProcessor{opts: opts, handler: handler}
+	p.stdout = &lineWriter{p: p, source: SourceStdout}
+	p.stderr = &lineWriter{p: p, source: SourceStderr}
+	return p
+}
+
+// LineChan returns a handler which sends lines to ch, it blocks while ch
+// is full and returns the error of ctx when it is done
+func LineChan(ctx context.Context, ch chan<- Line) func(Line) error {
+	return func(line Line) error {
+		select {
+		case ch <- line:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Stdout returns the writer of stdout lines
+func (p *LineProcessor) Stdout() io.Writer {
+	return p.stdout
+}
+
+// Stderr returns the writer of stderr lines
+func (p *LineProcessor) Stderr() io.Writer {
+	return p.stderr
+}
+
+// Flush passes the unterminated lines as partial lines, it must be called
+// after the output ended
+func (p *LineProcessor) Flush() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, w := range []*lineWriter{p.stdout, p.stderr} {
+		if p.err == nil && len(w.buf) > 0 {
+			p.emit(w.source, w.buf, true)
+		}
+		w.buf = nil
+	}
+	return p.err
+}
+
+// pass a line to the handler, p.mu must be held
+func (p *LineProcessor) emit(source LineSource, text []byte, partial bool) {
+	switch p.opts.CR {
+	case CRStrip:
+		text = bytes.Replace(text, []byte{'\r'}, nil, -1)
+	case CRNewline:
+		// a CR at the end of the output
+		text = bytes.TrimSuffix(text, []byte{'\r'})
+	case CROverwrite:
+		text = bytes.TrimRight(text, "\r")
+		if i := bytes.LastIndexByte(text, '\r'); i >= 0 {
+			text = text[i+1:]
+		}
+	}
+	s := string(text)
+	if p.opts.StripANSI {
+		s = ansiRe.ReplaceAllString(s, "")
+	}
+	p.err = p.handler(Line{Text: s, Source: source, Time: time.Now(), Partial: partial})
+}
+
+// lineWriter is a stream of a LineProcessor
+type lineWriter struct {
+	p      *LineProcessor
+	source LineSource
+	buf    []byte
+}
+
+func (w *lineWriter) Write(data []byte) (int, error) {
+	p := w.p
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err != nil {
+		return 0, p.err
+	}
+
+	w.buf = append(w.buf, data...)
+	for p.err == nil {
+		end, next := w.lineEnd()
+		if end < 0 || end > p.opts.MaxLineLength {
+			// wait for the terminator of a line of max length
+			if len(w.buf) <= p.opts.MaxLineLength {
+				break
+			}
+			// split the long line, even if it is terminated in the buffer
+			end, next = p.opts.MaxLineLength, p.opts.MaxLineLength
+			p.emit(w.source, w.buf[:end], true)
+		} else {
+			p.emit(w.source, w.buf[:end], false)
+		}
+		w.buf = w.buf[next:]
+	}
+	// do not keep the consumed buffer
+	if len(w.buf) == 0 {
+		w.buf = nil
+	}
+	if p.err != nil {
+		return 0, p.err
+	}
+	return len(data), nil
+}
+
+// find the first line terminator, returns the end of the line and the
+// start of the next line, or -1 if the line is not terminated yet
+func (w *lineWriter) lineEnd() (int, int) {
+	if w.p.opts.CR != CRNewline {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			return -1, -1
+		}
+		end := i
+		// CRLF
+		if w.p.opts.CR != CRKeep && end > 0 && w.buf[end-1] == '\r' {
+			end--
+		}
+		return end, i + 1
+	}
+
+	i := bytes.IndexAny(w.buf, "\r\n")
+	if i < 0 {
+		return -1, -1
+	}
+	if w.buf[i] == '\n' {
+		return i, i + 1
+	}
+	// CR, wait for the next byte to handle CRLF
+	if i+1 == len(w.buf) {
+		return -1, -1
+	}
+	if w.buf[i+1] == '\n' {
+		return i, i + 2
+	}
+	return i, i + 1
+}
+
+// RunLines runs the command and passes its output lines to handler, the
+// Stdout and Stderr of the command are ignored
+func (c *Command) RunLines(opts LineOptions, handler func(Line) error) error {
+	p := NewLineProcessor(opts, handler)
+	err := c.run(p.Stdout(), p.Stderr())
+	flushErr := p.Flush()
+	if err == nil {
+		err = flushErr
+	}
+	return err
+}
@@ -0,0 +1,124 @@
+package sshutils
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// a line without its time
+type testLine struct {
+	Text    string
+	Source  LineSource
+	Partial bool
+}
+
+// write data to the processor in chunks of n bytes, 0 writes it at once
+func processLines(t *testing.T, opts LineOptions, data string, n int) []testLine {
+	t.Helper()
+	var lines []testLine
+	p := NewLineProcessor(opts, func(l Line) error {
+		lines = append(lines, testLine{l.Text, l.Source, l.Partial})
+		return nil
+	})
+	if n == 0 {
+		n = len(data) + 1
+	}
+	for i := 0; i < len(data); i += n {
+		end := i + n
+		if end > len(data) {
+			end = len(data)
+		}
+		if _, err := p.Stdout().Write([]byte(data[i:end])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := p.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	return lines
+}
+
+func TestLineWriter(t *testing.T) {
+	const progress = "a\r\nb\rc\r\n\r\nd\r"
+	full := func(texts ...string) []testLine {
+		var lines []testLine
+		for _, text := range texts {
+			lines = append(lines, testLine{Text: text})
+		}
+		return lines
+	}
+	partial := func(lines []testLine, text string) []testLine {
+		return append(lines, testLine{Text: text, Partial: true})
+	}
+	tests := []struct {
+		name string
+		opts LineOptions
+		data string
+		want []testLine
+	}{
+		{name: "lf", data: "a\nb\n", want: full("a", "b")},
+		{name: "unterminated", data: "a\nb", want: partial(full("a"), "b")},
+		{name: "empty lines", data: "\n\n", want: full("", "")},
+		{name: "strip", opts: LineOptions{CR: CRStrip}, data: progress, want: partial(full("a", "bc", ""), "d")},
+		{name: "newline", opts: LineOptions{CR: CRNewline}, data: progress, want: partial(full("a", "b", "c", ""), "d")},
+		{name: "overwrite", opts: LineOptions{CR: CROverwrite}, data: progress, want: partial(full("a", "c", ""), "d")},
+		{name: "keep", opts: LineOptions{CR: CRKeep}, data: progress, want: partial(full("a\r", "b\rc\r", "\r"), "d\r")},
+		{name: "newline cr cr", opts: LineOptions{CR: CRNewline}, data: "a\r\rb\n", want: full("a", "", "b")},
+		{name: "ansi", opts: LineOptions{StripANSI: true}, data: "\x1b[1;31mred\x1b[0m \x1b]0;title\x07ok\n", want: full("red ok")},
+		{name: "max length", opts: LineOptions{MaxLineLength: 3}, data: "abcdefg\nhi\n", want: []testLine{
+			{Text: "abc", Partial: true}, {Text: "def", Partial: true}, {Text: "g"}, {Text: "hi"},
+		}},
+		{name: "exact max length", opts: LineOptions{MaxLineLength: 3}, data: "abc\nabcd\n", want: []testLine{
+			{Text: "abc"}, {Text: "abc", Partial: true}, {Text: "d"},
+		}},
+	}
+	for _, tt := range tests {
+		// the result must not depend on how the output is split
+		for _, n := range []int{0, 1, 3} {
+			got := processLines(t, tt.opts, tt.data, n)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("%s (chunk %d): got %+v, want %+v", tt.name, n, got, tt.want)
+			}
+		}
+	}
+}
+
+func TestLineProcessorSources(t *testing.T) {
+	var got []testLine
+	p := NewLineProcessor(LineOptions{}, func(l Line) error {
+		got = append(got, testLine{l.Text, l.Source, l.Partial})
+		return nil
+	})
+	_, _ = p.Stdout().Write([]byte("o1\no"))
+	_, _ = p.Stderr().Write([]byte("e1\n"))
+	_, _ = p.Stdout().Write([]byte("2\n"))
+	if err := p.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	want := []testLine{{Text: "o1"}, {Text: "e1", Source: SourceStderr}, {Text: "o2"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestLineProcessorHandlerError(t *testing.T) {
+	stop := errors.New("stop")
+	calls := 0
+	p := NewLineProcessor(LineOptions{}, func(l Line) error {
+		calls++
+		return stop
+	})
+	if _, err := p.Stdout().Write([]byte("a\nb\n")); err != stop {
+		t.Fatalf("write error = %v, want %v", err, stop)
+	}
+	if _, err := p.Stderr().Write([]byte("c\n")); err != stop {
+		t.Fatalf("second write error = %v, want %v", err, stop)
+	}
+	if err := p.Flush(); err != stop {
+		t.Fatalf("flush error = %v, want %v", err, stop)
+	}
+	if calls != 1 {
+		t.Fatalf("handler called %d times, want 1", calls)
+	}
+}
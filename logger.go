@@ -0,0 +1,66 @@
+package sshutils
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Logger receives structured events, keyvals are alternating key and value
+// pairs; *slog.Logger from log/slog satisfies this interface
+type Logger interface {
+	Debug(msg string, keyvals ...interface{})
+	Info(msg string, keyvals ...interface{})
+	Warn(msg string, keyvals ...interface{})
+	Error(msg string, keyvals ...interface{})
+}
+
+// NopLogger discards all events, it is the default logger
+type NopLogger struct{}
+
+func (NopLogger) Debug(msg string, keyvals ...interface{}) {}
+func (NopLogger) Info(msg string, keyvals ...interface{})  {}
+func (NopLogger) Warn(msg string, keyvals ...interface{})  {}
+func (NopLogger) Error(msg string, keyvals ...interface{}) {}
+
+// StdLogger writes events as "LEVEL msg key=value ..." lines to a *log.Logger
+type StdLogger struct {
+	Logger *log.Logger
+}
+
+// NewStdLogger creates a StdLogger, nil uses the output settings of the standard logger
+func NewStdLogger(l *log.Logger) *StdLogger {
+	if l == nil {
+		l = log.New(log.Writer(), log.Prefix(), log.Flags())
+	}
+	return &StdLogger{Logger: l}
+}
+
+func (l *StdLogger) Debug(msg string, keyvals ...interface{}) { l.output("DEBUG", msg, keyvals) }
+func (l *StdLogger) Info(msg string, keyvals ...interface{})  { l.output("INFO", msg, keyvals) }
+func (l *StdLogger) Warn(msg string, keyvals ...interface{})  { l.output("WARN", msg, keyvals) }
+func (l *StdLogger) Error(msg string, keyvals ...interface{}) { l.output("ERROR", msg, keyvals) }
+
+func (l *StdLogger) output(level, msg string, keyvals []interface{}) {
+	var b strings.Builder
+	b.WriteString(level)
+	b.WriteString(" ")
+	b.WriteString(msg)
+	for i := 0; i < len(keyvals); i += 2 {
+		b.WriteString(" ")
+		if i+1 < len(keyvals) {
+			_, _ = fmt.Fprintf(&b, "%v=%v", keyvals[i], keyvals[i+1])
+		} else {
+			_, _ = fmt.Fprintf(&b, "%v=<missing>", keyvals[i])
+		}
+	}
+	_ = l.Logger.Output(3, b.String())
+}
+
+// return logger or NopLogger if nil
+func loggerOrNop(l Logger) Logger {
+	if l == nil {
+		return NopLogger{}
+	}
+	return l
+}
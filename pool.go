@@ -0,0 +1,367 @@
+package sshutils
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// default MaxSessions of OpenSSH
+const defaultMaxSessions = 10
+
+// ErrPoolClosed means the pool was closed
+var ErrPoolClosed = errors.New("pool closed")
+
+// PoolConfig configures a Pool
+type PoolConfig struct {
+	// max sessions per connection, default 10 like MaxSessions of OpenSSH
+	MaxSessions int
+	// idle connections are closed after this timeout, default 5min
+	IdleTimeout time.Duration
+	// interval of idle connection keepalive checks, default 30s
+	HealthCheckInterval time.Duration
+	Logger              Logger
+}
+
+// Pool caches authenticated connections per host and user, and multiplexes
+// sessions on them, it is safe for concurrent use
+type Pool struct {
+	cfg PoolConfig
+
+	mu    sync.Mutex
+	conns map[string][]*PoolConn
+	// keys being dialed, removed when the last dialer is done
+	dials  map[string]*poolDial
+	closed bool
+	stopCh chan struct{}
+}
+
+// PoolConn is a pooled connection
+type PoolConn struct {
+	pool *Pool
+	key  string
+	// the connection, do not close it
+	client *ssh.Client
+	// max sessions, lowered if the server refuses sessions
+	maxSessions int
+	// sessions in use, guarded by pool.mu
+	inUse    int
+	lastUsed time.Time
+	closed   bool
+}
+
+// poolDial serializes the dials of a key
+type poolDial struct {
+	mu sync.Mutex
+	// callers waiting for or holding mu, guarded by pool.mu
+	waiters int
+}
+
+// PoolSession is a session on a pooled connection, Close releases the
+// session slot
+type PoolSession struct {
+	*ssh.Session
+	conn *PoolConn
+	once sync.Once
+}
+
+// NewPool creates a pool and starts the idle connection health check
+func NewPool(cfg PoolConfig) *Pool {
+	if cfg.MaxSessions <= 0 {
+		cfg.MaxSessions = defaultMaxSessions
+	}
+	if cfg.IdleTimeout <= 0 {
+		cfg.IdleTimeout = 5 * time.Minute
+	}
+	if cfg.HealthCheckInterval <= 0 {
+		cfg.HealthCheckInterval = 30 * time.Second
+	}
+	cfg.Logger = loggerOrNop(cfg.Logger)
+
+	p := &Pool{
+		cfg:    cfg,
+		conns:  make(map[string][]*PoolConn),
+		dials:  make(map[string]*poolDial),
+		stopCh: make(chan struct{}),
+	}
+	go p.healthCheckLoop()
+	return p
+}
+
+// pool key of the connection
+func poolKey(network, addr, user string) string {
+	return network + "://" + user + "@" + addr
+}
+
+// Acquire reserves a session slot on a pooled connection to addr, a new
+// connection is dialed if all connections are busy; the caller must call
+// Release when the session is closed
+func (p *Pool) Acquire(network, addr string, config *ssh.ClientConfig) (*PoolConn, error) {
+	key := poolKey(network, addr, config.User)
+
+	conn, err := p.acquire(key)
+	if conn != nil || err != nil {
+		return conn, err
+	}
+
+	// only one dial per key at once, other callers may use the new connection
+	p.mu.Lock()
+	dial, ok := p.dials[key]
+	if !ok {
+		dial = &poolDial{}
+		p.dials[key] = dial
+	}
+	dial.waiters++
+	p.mu.Unlock()
+	dial.mu.Lock()
+	defer func() {
+		dial.mu.Unlock()
+		p.mu.Lock()
+		dial.waiters--
+		if dial.waiters == 0 {
+			delete(p.dials, key)
+		}
+		p.mu.Unlock()
+	}()
+
+	conn, err = p.acquire(key)
+	if conn != nil || err != nil {
+		return conn, err
+	}
+
+	client, err := DialWithLogger(network, addr, config, p.cfg.Logger)
+	if err != nil {
+		return nil, err
+	}
+
+	conn = &PoolConn{
+		pool:        p,
+		key:         key,
+		client:      client,
+		maxSessions: p.cfg.MaxSessions,
+		inUse:       1,
+		lastUsed:    time.Now(),
+	}
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		_ = client.Close()
+		return nil, ErrPoolClosed
+	}
+	p.conns[key] = append(p.conns[key], conn)
+	p.mu.Unlock()
+	p.cfg.Logger.Debug("pool connection added", "key", key)
+
+	// remove the connection when it is closed by other reasons
+	go func() {
+		_ = client.Wait()
+		p.remove(conn)
+	}()
+	return conn, nil
+}
+
+// reserve a session slot on an existing connection, returns nil if
+// all connections are busy
+func (p *Pool) acquire(key string) (*PoolConn, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return nil, ErrPoolClosed
+	}
+	for _, conn := range p.conns[key] {
+		if !conn.closed && conn.inUse < conn.maxSessions {
+			conn.inUse++
+			conn.lastUsed = time.Now()
+			return conn, nil
+		}
+	}
+	return nil, nil
+}
+
+// NewSession opens a session on a pooled connection to addr, if the server
+// refuses the session because of its MaxSessions another connection is used
+func (p *Pool) NewSession(network, addr string, config *ssh.ClientConfig) (*PoolSession, error) {
+	for {
+		conn, err := p.Acquire(network, addr, config)
+		if err != nil {
+			return nil, err
+		}
+		session, err := conn.client.NewSession()
+		if err == nil {
+			return &PoolSession{Session: session, conn: conn}, nil
+		}
+
+		var chanErr *ssh.OpenChannelError
+		if !errors.As(err, &chanErr) || (chanErr.Reason != ssh.Prohibited && chanErr.Reason != ssh.ResourceShortage) {
+			conn.Release()
+			return nil, err
+		}
+
+		// the server refuses any session, another connection does not help
+		p.mu.Lock()
+		first := conn.inUse == 1
+		if !first {
+			// the server limit is lower, do not open more sessions than in use
+			conn.maxSessions = conn.inUse - 1
+		}
+		limit := conn.maxSessions
+		p.mu.Unlock()
+		conn.Release()
+		if first {
+			return nil, err
+		}
+		p.cfg.Logger.Debug("session refused, lower max sessions", "key", conn.key, "max_sessions", limit, "error", err)
+	}
+}
+
+// Close closes the session and releases its slot
+func (s *PoolSession) Close() error {
+	err := s.Session.Close()
+	s.once.Do(s.conn.Release)
+	return err
+}
+
+// Client returns the connection, do not close it
+func (c *PoolConn) Client() *ssh.Client {
+	return c.client
+}
+
+// Release releases the session slot reserved by Acquire
+func (c *PoolConn) Release() {
+	p := c.pool
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if c.inUse > 0 {
+		c.inUse--
+	}
+	c.lastUsed = time.Now()
+}
+
+// Len returns the number of pooled connections
+func (p *Pool) Len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n := 0
+	for _, conns := range p.conns {
+		n += len(conns)
+	}
+	return n
+}
+
+// Close closes all connections, sessions in use are closed too
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	p.closed = true
+	close(p.stopCh)
+	var conns []*PoolConn
+	for _, cs := range p.conns {
+		conns = append(conns, cs...)
+	}
+	p.conns = make(map[string][]*PoolConn)
+	p.mu.Unlock()
+
+	var err error
+	for _, conn := range conns {
+		if closeErr := conn.client.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// remove the connection from the pool
+func (p *Pool) remove(conn *PoolConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	conn.closed = true
+	conns := p.conns[conn.key]
+	for i, c := range conns {
+		if c == conn {
+			p.conns[conn.key] = append(conns[:i:i], conns[i+1:]...)
+			break
+		}
+	}
+	if len(p.conns[conn.key]) == 0 {
+		delete(p.conns, conn.key)
+	}
+}
+
+// close idle connections after IdleTimeout and check the others by keepalive
+func (p *Pool) healthCheckLoop() {
+	ticker := time.NewTicker(p.cfg.HealthCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stopCh:
+			return
+		case <-ticker.C:
+		}
+
+		var expired, idle []*PoolConn
+		p.mu.Lock()
+		for _, conns := range p.conns {
+			for _, conn := range conns {
+				if conn.inUse > 0 {
+					continue
+				}
+				// closed is set by a failed check of a connection in use
+				if conn.closed || time.Since(conn.lastUsed) >= p.cfg.IdleTimeout {
+					// mark closed so it is not acquired any more
+					conn.closed = true
+					expired = append(expired, conn)
+				} else {
+					idle = append(idle, conn)
+				}
+			}
+		}
+		p.mu.Unlock()
+
+		for _, conn := range expired {
+			p.cfg.Logger.Debug("pool connection idle timeout", "key", conn.key)
+			p.remove(conn)
+			_ = conn.client.Close()
+		}
+		for _, conn := range idle {
+			go p.healthCheck(conn)
+		}
+	}
+}
+
+// send a keepalive, the connection is closed if there is no reply in time
+func (p *Pool) healthCheck(conn *PoolConn) {
+	replyCh := make(chan error, 1)
+	go func() {
+		_, _, err := conn.client.SendRequest("keepalive@openssh.com", true, nil)
+		replyCh <- err
+	}()
+
+	var err error
+	select {
+	case err = <-replyCh:
+	case <-time.After(p.cfg.HealthCheckInterval):
+		err = ErrKeepAliveTimeout
+	}
+	if err == nil {
+		return
+	}
+
+	// the connection may have been acquired during the check, do not hand
+	// it out any more but keep its sessions, it is closed when idle
+	p.mu.Lock()
+	inUse := conn.inUse > 0
+	conn.closed = true
+	p.mu.Unlock()
+	if inUse {
+		p.cfg.Logger.Warn("pool connection health check failed, close it when idle", "key", conn.key, "error", err)
+		return
+	}
+	p.cfg.Logger.Warn("pool connection health check failed", "key", conn.key, "error", err)
+	p.remove(conn)
+	_ = conn.client.Close()
+}
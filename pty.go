@@ -0,0 +1,154 @@
+package sshutils
+
+import (
+	"errors"
+	"os"
+	"sort"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// IUTF8 terminal mode of RFC 8160, not defined by x/crypto/ssh
+const ptyIUTF8 = 42
+
+// PtyOptions configures the pseudo terminal of a session
+type PtyOptions struct {
+	// terminal type, default is $TERM or xterm-256color
+	Term string
+	// terminal modes, merged over the default modes
+	Modes ssh.TerminalModes
+	// size in characters, default is the local terminal size or 80x24
+	Width  int
+	Height int
+	// size in pixels, 0 if unknown
+	WidthPixels  int
+	HeightPixels int
+}
+
+// default terminal modes of a sane terminal, used when the local
+// terminal modes can not be read
+func defaultTerminalModes() ssh.TerminalModes {
+	return ssh.TerminalModes{
+		ssh.VINTR:         3,
+		ssh.VQUIT:         28,
+		ssh.VERASE:        127,
+		ssh.VKILL:         21,
+		ssh.VEOF:          4,
+		ssh.VSTART:        17,
+		ssh.VSTOP:         19,
+		ssh.VSUSP:         26,
+		ssh.VREPRINT:      18,
+		ssh.VWERASE:       23,
+		ssh.VLNEXT:        22,
+		ssh.VDISCARD:      15,
+		ssh.ICRNL:         1,
+		ssh.IXON:          1,
+		ssh.IMAXBEL:       1,
+		ptyIUTF8:          1,
+		ssh.ISIG:          1,
+		ssh.ICANON:        1,
+		ssh.IEXTEN:        1,
+		ssh.ECHO:          1,
+		ssh.ECHOE:         1,
+		ssh.ECHOK:         1,
+		ssh.ECHOCTL:       1,
+		ssh.ECHOKE:        1,
+		ssh.OPOST:         1,
+		ssh.ONLCR:         1,
+		ssh.CS8:           1,
+		ssh.TTY_OP_ISPEED: 38400,
+		ssh.TTY_OP_OSPEED: 38400,
+	}
+}
+
+// DefaultPtyOptions returns options like OpenSSH sends, derived from the
+// local terminal fd: $TERM, terminal modes and window size; defaults are
+// used if fd is not a terminal
+func DefaultPtyOptions(fd int) *PtyOptions {
+	opts := &PtyOptions{
+		Term:   os.Getenv("TERM"),
+		Modes:  terminalModes(fd),
+		Width:  80,
+		Height: 24,
+	}
+	// default to xterm-256color
+	if opts.Term == "" {
+		opts.Term = "xterm-256color"
+	}
+	if opts.Modes == nil {
+		opts.Modes = defaultTerminalModes()
+	}
+
+	width, height, err := terminal.GetSize(fd)
+	if err == nil && width > 0 && height > 0 {
+		opts.Width, opts.Height = width, height
+	}
+	opts.WidthPixels, opts.HeightPixels = terminalPixels(fd)
+	return opts
+}
+
+// merge the non-zero fields of o over def
+func (o *PtyOptions) merge(def *PtyOptions) *PtyOptions {
+	merged := *def
+	merged.Modes = make(ssh.TerminalModes, len(def.Modes))
+	for k, v := range def.Modes {
+		merged.Modes[k] = v
+	}
+	if o == nil {
+		return &merged
+	}
+
+	if o.Term != "" {
+		merged.Term = o.Term
+	}
+	for k, v := range o.Modes {
+		merged.Modes[k] = v
+	}
+	if o.Width > 0 && o.Height > 0 {
+		merged.Width, merged.Height = o.Width, o.Height
+	}
+	if o.WidthPixels > 0 && o.HeightPixels > 0 {
+		merged.WidthPixels, merged.HeightPixels = o.WidthPixels, o.HeightPixels
+	}
+	return &merged
+}
+
+// request pty by opts, unlike ssh.Session.RequestPty it sends the pixel size
+func requestPty(session *ssh.Session, opts *PtyOptions) error {
+	// sort the modes to send them in a stable order
+	opcodes := make([]int, 0, len(opts.Modes))
+	for k := range opts.Modes {
+		opcodes = append(opcodes, int(k))
+	}
+	sort.Ints(opcodes)
+
+	var modes []byte
+	for _, k := range opcodes {
+		modes = append(modes, byte(k))
+		modes = appendUint32(modes, opts.Modes[uint8(k)])
+	}
+	// TTY_OP_END
+	modes = append(modes, 0)
+
+	req := struct {
+		Term     string
+		Columns  uint32
+		Rows     uint32
+		Width    uint32
+		Height   uint32
+		Modelist string
+	}{
+		Term:     opts.Term,
+		Columns:  uint32(opts.Width),
+		Rows:     uint32(opts.Height),
+		Width:    uint32(opts.WidthPixels),
+		Height:   uint32(opts.HeightPixels),
+		Modelist: string(modes),
+	}
+	ok, err := session.SendRequest("pty-req", true, ssh.Marshal(&req))
+	if err == nil && !ok {
+		err = errors.New("ssh: pty-req failed")
+	}
+	return err
+}
@@ -0,0 +1,173 @@
+package sshutils
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// RateLimiter is a token bucket limiting bytes per second, it is safe for
+// concurrent use and the limit can be changed at any time
+type RateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter creates a rate limiter, bytesPerSec <= 0 means unlimited
+// and burst <= 0 defaults to one second of traffic
+func NewRateLimiter(bytesPerSec, burst int) *RateLimiter {
+	l := &RateLimiter{}
+	l.SetLimit(bytesPerSec, burst)
+	return l
+}
+
+// SetLimit changes the limit, bytesPerSec <= 0 means unlimited
+func (l *RateLimiter) SetLimit(bytesPerSec, burst int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if burst <= 0 {
+		burst = bytesPerSec
+	}
+	l.rate = float64(bytesPerSec)
+	l.burst = float64(burst)
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = time.Now()
+}
+
+// Limit returns the current bytes per second and burst
+func (l *RateLimiter) Limit() (int, int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return int(l.rate), int(l.burst)
+}
+
+// WaitN blocks until n bytes may pass
+func (l *RateLimiter) WaitN(n int) {
+	for n > 0 {
+		l.mu.Lock()
+		if l.rate <= 0 {
+			l.mu.Unlock()
+			return
+		}
+
+		// refill
+		now := time.Now()
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if l.tokens > l.burst {
+			l.tokens = l.burst
+		}
+		l.last = now
+
+		// take at most burst bytes at once
+		take := float64(n)
+		if take > l.burst {
+			take = l.burst
+		}
+		if l.tokens >= take {
+			l.tokens -= take
+			n -= int(take)
+			l.mu.Unlock()
+			continue
+		}
+		wait := time.Duration((take - l.tokens) / l.rate * float64(time.Second))
+		l.mu.Unlock()
+		time.Sleep(wait)
+	}
+}
+
+type rateLimitedReader struct {
+	r        io.Reader
+	limiters []*RateLimiter
+}
+
+func (r *rateLimitedReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	for _, l := range r.limiters {
+		l.WaitN(n)
+	}
+	return n, err
+}
+
+// NewRateLimitedReader returns a reader which is limited by all limiters
+func NewRateLimitedReader(r io.Reader, limiters ...*RateLimiter) io.Reader {
+	var ls []*RateLimiter
+	for _, l := range limiters {
+		if l != nil {
+			ls = append(ls, l)
+		}
+	}
+	if len(ls) == 0 {
+		return r
+	}
+	return &rateLimitedReader{r: r, limiters: ls}
+}
+
+type rateLimitedWriter struct {
+	w        io.Writer
+	limiters []*RateLimiter
+}
+
+func (w *rateLimitedWriter) Write(p []byte) (int, error) {
+	for _, l := range w.limiters {
+		l.WaitN(len(p))
+	}
+	return w.w.Write(p)
+}
+
+// NewRateLimitedWriter returns a writer which is limited by all limiters
+func NewRateLimitedWriter(w io.Writer, limiters ...*RateLimiter) io.Writer {
+	var ls []*RateLimiter
+	for _, l := range limiters {
+		if l != nil {
+			ls = append(ls, l)
+		}
+	}
+	if len(ls) == 0 {
+		return w
+	}
+	return &rateLimitedWriter{w: w, limiters: ls}
+}
+
+// SetRateLimit limits every single transfer of this client, it also applies
+// to transfers which are already running
+func (s *scpClient) SetRateLimit(bytesPerSec, burst int) {
+	s.limitMu.Lock()
+	defer s.limitMu.Unlock()
+
+	s.transferRate, s.transferBurst = bytesPerSec, burst
+	for l := range s.transferLimiters {
+		l.SetLimit(bytesPerSec, burst)
+	}
+}
+
+// SetGlobalRateLimit limits the sum of all concurrent transfers of this client
+func (s *scpClient) SetGlobalRateLimit(bytesPerSec, burst int) {
+	s.globalLimiter.SetLimit(bytesPerSec, burst)
+}
+
+// GlobalRateLimiter returns the limiter shared by all transfers of this client,
+// it can be passed to SSHSession.SetRateLimiter to share the bandwidth
+func (s *scpClient) GlobalRateLimiter() *RateLimiter {
+	return s.globalLimiter
+}
+
+// new limiter for a single transfer, done must be called when the transfer finished
+func (s *scpClient) newTransferLimiter() (*RateLimiter, func()) {
+	s.limitMu.Lock()
+	defer s.limitMu.Unlock()
+
+	l := NewRateLimiter(s.transferRate, s.transferBurst)
+	s.transferLimiters[l] = struct{}{}
+	done := func() {
+		s.limitMu.Lock()
+		delete(s.transferLimiters, l)
+		s.limitMu.Unlock()
+	}
+	return l, done
+}
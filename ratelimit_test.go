@@ -0,0 +1,96 @@
+package sshutils
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterLimit(t *testing.T) {
+	tests := []struct {
+		rate, burst         int
+		wantRate, wantBurst int
+	}{
+		{0, 0, 0, 0},
+		{-1, 0, -1, -1},
+		{1000, 0, 1000, 1000},
+		{1000, 10, 1000, 10},
+	}
+	for _, tt := range tests {
+		l := NewRateLimiter(tt.rate, tt.burst)
+		if rate, burst := l.Limit(); rate != tt.wantRate || burst != tt.wantBurst {
+			t.Errorf("NewRateLimiter(%d, %d).Limit() = %d, %d, want %d, %d", tt.rate, tt.burst, rate, burst, tt.wantRate, tt.wantBurst)
+		}
+	}
+}
+
+// the limiter starts without tokens, so n bytes take about n/rate
+func TestRateLimiterWait(t *testing.T) {
+	tests := []struct {
+		name     string
+		limiters []*RateLimiter
+		n        int
+		want     time.Duration
+	}{
+		{name: "unlimited", limiters: []*RateLimiter{NewRateLimiter(0, 0)}, n: 1 << 20},
+		{name: "nil", limiters: []*RateLimiter{nil}, n: 1 << 20},
+		{name: "rate", limiters: []*RateLimiter{NewRateLimiter(100000, 10000)}, n: 30000, want: 300 * time.Millisecond},
+		{name: "burst over n", limiters: []*RateLimiter{NewRateLimiter(100000, 1<<20)}, n: 20000, want: 200 * time.Millisecond},
+		{
+			name:     "slowest limiter",
+			limiters: []*RateLimiter{NewRateLimiter(1<<20, 0), NewRateLimiter(100000, 10000)},
+			n:        20000,
+			want:     200 * time.Millisecond,
+		},
+	}
+	for _, tt := range tests {
+		for _, dir := range []string{"reader", "writer"} {
+			// reset the tokens of the shared limiters
+			for _, l := range tt.limiters {
+				if l != nil {
+					l.SetLimit(l.Limit())
+					l.tokens = 0
+				}
+			}
+			data := bytes.NewReader(make([]byte, tt.n))
+			start := time.Now()
+			var err error
+			if dir == "reader" {
+				_, err = io.Copy(ioutil.Discard, NewRateLimitedReader(data, tt.limiters...))
+			} else {
+				_, err = io.Copy(NewRateLimitedWriter(ioutil.Discard, tt.limiters...), data)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			elapsed := time.Since(start)
+			if elapsed < tt.want*8/10 || elapsed > tt.want+200*time.Millisecond {
+				t.Errorf("%s %s: took %v, want about %v", tt.name, dir, elapsed, tt.want)
+			}
+		}
+	}
+}
+
+func TestSCPClientRateLimit(t *testing.T) {
+	s := &scpClient{transferLimiters: make(map[*RateLimiter]struct{}), globalLimiter: NewRateLimiter(0, 0)}
+	s.SetRateLimit(1000, 100)
+	l, done := s.newTransferLimiter()
+	if rate, burst := l.Limit(); rate != 1000 || burst != 100 {
+		t.Errorf("transfer limit = %d, %d", rate, burst)
+	}
+	// running transfers follow the change
+	s.SetRateLimit(2000, 0)
+	if rate, burst := l.Limit(); rate != 2000 || burst != 2000 {
+		t.Errorf("changed transfer limit = %d, %d", rate, burst)
+	}
+	done()
+	if len(s.transferLimiters) != 0 {
+		t.Errorf("%d limiters after done", len(s.transferLimiters))
+	}
+	s.SetGlobalRateLimit(500, 0)
+	if rate, _ := s.GlobalRateLimiter().Limit(); rate != 500 {
+		t.Errorf("global limit = %d", rate)
+	}
+}
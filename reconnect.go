@@ -0,0 +1,406 @@
+package sshutils
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/mitchellh/go-homedir"
+	"golang.org/x/crypto/ssh"
+)
+
+// ReconnectConfig configures a Reconnector
+type ReconnectConfig struct {
+	Network      string
+	Addr         string
+	ClientConfig *ssh.ClientConfig
+	// first backoff delay, default 1s
+	InitialBackoff time.Duration
+	// max backoff delay, default 1min
+	MaxBackoff time.Duration
+	// backoff multiplier, default 2
+	Multiplier float64
+	// random factor in [0, 1] applied to every delay, default 0.2
+	Jitter float64
+	// max reconnect attempts in a row, 0 means unlimited
+	MaxRetries int
+	// connection level keepalive, 0 disables it
+	KeepAliveInterval time.Duration
+	KeepAliveCountMax int
+	// called for every new scp client, e.g. to set options
+	SCPSetup func(scp *scpClient)
+	Logger   Logger
+	// called on every reconnect event
+	OnEvent func(event ReconnectEvent)
+}
+
+// ReconnectEvent describes a connection loss or a reconnect attempt
+type ReconnectEvent struct {
+	// reconnect attempt, starts with 1
+	Attempt int
+	// the error which caused the reconnect or failed the attempt
+	Err error
+	// delay before the next attempt
+	Delay time.Duration
+	// true if the attempt succeeded
+	Connected bool
+}
+
+// ResumeFunc returns the command to run after a reconnect, lastOutput is the
+// time of the last output seen and is zero if there was none
+type ResumeFunc func(lastOutput time.Time) string
+
+// Reconnector keeps a connection and redials with exponential backoff and
+// jitter when it is lost
+type Reconnector struct {
+	cfg ReconnectConfig
+
+	// held while dialing, so one dial runs at a time
+	dialCh chan struct{}
+
+	mu        sync.Mutex
+	client    *ssh.Client
+	keepAlive *KeepAlive
+	closedCh  chan struct{}
+	lastSeen  time.Time
+}
+
+// NewReconnector creates a Reconnector, the connection is dialed on first use
+func NewReconnector(cfg ReconnectConfig) *Reconnector {
+	if cfg.Network == "" {
+		cfg.Network = "tcp"
+	}
+	if cfg.InitialBackoff <= 0 {
+		cfg.InitialBackoff = time.Second
+	}
+	if cfg.MaxBackoff <= 0 {
+		cfg.MaxBackoff = time.Minute
+	}
+	if cfg.Multiplier < 1 {
+		cfg.Multiplier = 2
+	}
+	if cfg.Jitter == 0 {
+		cfg.Jitter = 0.2
+	}
+	cfg.Logger = loggerOrNop(cfg.Logger)
+	return &Reconnector{cfg: cfg, dialCh: make(chan struct{}, 1)}
+}
+
+// Client returns the current connection, it dials with backoff if there is none
+func (r *Reconnector) Client(ctx context.Context) (*ssh.Client, error) {
+	r.mu.Lock()
+	client := r.client
+	r.mu.Unlock()
+	if client != nil {
+		return client, nil
+	}
+	return r.reconnect(ctx, nil, nil)
+}
+
+// Close closes the current connection
+func (r *Reconnector) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.client == nil {
+		return nil
+	}
+	if r.keepAlive != nil {
+		r.keepAlive.Stop()
+	}
+	err := r.client.Close()
+	r.client = nil
+	return err
+}
+
+// LastOutput returns the time of the last output seen by any Exec
+func (r *Reconnector) LastOutput() time.Time {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.lastSeen
+}
+
+// drop the failed connection and dial a new one with backoff, cause is the
+// error which caused the reconnect; if another caller already replaced the
+// failed connection, the new one is returned
+func (r *Reconnector) reconnect(ctx context.Context, failed *ssh.Client, cause error) (*ssh.Client, error) {
+	select {
+	case r.dialCh <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	defer func() {
+		<-r.dialCh
+	}()
+
+	r.mu.Lock()
+	current := r.client
+	r.mu.Unlock()
+	if current != nil && current != failed {
+		return current, nil
+	}
+	_ = r.Close()
+
+	for attempt := 1; ; attempt++ {
+		client, err := DialWithLogger(r.cfg.Network, r.cfg.Addr, r.cfg.ClientConfig, r.cfg.Logger)
+		if err == nil {
+			r.mu.Lock()
+			r.client = client
+			r.closedCh = make(chan struct{})
+			closedCh := r.closedCh
+			if r.cfg.KeepAliveInterval > 0 {
+				r.keepAlive = StartKeepAliveWithLogger(client, r.cfg.KeepAliveInterval, r.cfg.KeepAliveCountMax, r.cfg.Logger)
+			}
+			r.mu.Unlock()
+			go func() {
+				_ = client.Wait()
+				close(closedCh)
+			}()
+
+			if cause != nil {
+				r.cfg.Logger.Info("reconnected", "host", r.cfg.Addr, "attempt", attempt)
+				r.event(ReconnectEvent{Attempt: attempt, Err: cause, Connected: true})
+			}
+			return client, nil
+		}
+
+		// authentication and host key failures will not recover
+		var authErr *AuthError
+		var hostKeyErr *HostKeyError
+		if errors.As(err, &authErr) || errors.As(err, &hostKeyErr) {
+			return nil, err
+		}
+		if r.cfg.MaxRetries > 0 && attempt >= r.cfg.MaxRetries {
+			return nil, err
+		}
+
+		delay := r.backoff(attempt)
+		r.cfg.Logger.Warn("reconnect failed", "host", r.cfg.Addr, "attempt", attempt, "delay", delay, "error", err)
+		r.event(ReconnectEvent{Attempt: attempt, Err: err, Delay: delay})
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// exponential backoff delay with jitter for attempt
+func (r *Reconnector) backoff(attempt int) time.Duration {
+	delay := float64(r.cfg.InitialBackoff) * math.Pow(r.cfg.Multiplier, float64(attempt-1))
+	if delay > float64(r.cfg.MaxBackoff) {
+		delay = float64(r.cfg.MaxBackoff)
+	}
+	delay *= 1 + r.cfg.Jitter*(rand.Float64()*2-1)
+	return time.Duration(delay)
+}
+
+func (r *Reconnector) event(e ReconnectEvent) {
+	if r.cfg.OnEvent != nil {
+		r.cfg.OnEvent(e)
+	}
+}
+
+// check err was caused by losing the connection of client
+func (r *Reconnector) connectionLost(client *ssh.Client, err error) bool {
+	if errors.Is(err, ErrKeepAliveTimeout) {
+		return true
+	}
+
+	r.mu.Lock()
+	closedCh := r.closedCh
+	current := r.client == client
+	r.mu.Unlock()
+	if !current || closedCh == nil {
+		return true
+	}
+
+	// the connection close may be noticed a little later than the error
+	select {
+	case <-closedCh:
+		return true
+	case <-time.After(100 * time.Millisecond):
+		return false
+	}
+}
+
+// run fn with the current connection and retry it on a new connection
+// if the connection was lost
+func (r *Reconnector) retry(ctx context.Context, fn func(client *ssh.Client) error) error {
+	client, err := r.Client(ctx)
+	if err != nil {
+		return err
+	}
+	for {
+		err = fn(client)
+		if err == nil || !r.connectionLost(client, err) {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		r.cfg.Logger.Warn("connection lost", "host", r.cfg.Addr, "error", err)
+		r.event(ReconnectEvent{Err: err})
+		client, err = r.reconnect(ctx, client, err)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Exec runs cmd and writes its output to stdout and stderr, if the connection
+// is lost it reconnects and runs the command again, or the command returned
+// by resume if not nil; it returns when the command exits
+func (r *Reconnector) Exec(ctx context.Context, cmd string, resume ResumeFunc, stdout, stderr io.Writer) error {
+	first := true
+	// the last output of this command
+	var lastSeen time.Time
+	return r.retry(ctx, func(client *ssh.Client) error {
+		runCmd := cmd
+		if !first && resume != nil {
+			r.mu.Lock()
+			seen := lastSeen
+			r.mu.Unlock()
+			runCmd = resume(seen)
+		}
+		first = false
+
+		session, err := client.NewSession()
+		if err != nil {
+			return err
+		}
+		defer func() {
+			_ = session.Close()
+		}()
+		session.Stdout = &lastSeenWriter{w: stdout, r: r, seen: &lastSeen}
+		session.Stderr = &lastSeenWriter{w: stderr, r: r, seen: &lastSeen}
+
+		// close the session when ctx is done
+		doneCh := make(chan struct{})
+		defer close(doneCh)
+		go func() {
+			select {
+			case <-ctx.Done():
+				_ = session.Close()
+			case <-doneCh:
+			}
+		}()
+
+		r.cfg.Logger.Info("exec started", "host", r.cfg.Addr, "cmd", runCmd)
+		err = newRemoteExitError(r.cfg.Addr, runCmd, "", session.Run(runCmd))
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	})
+}
+
+// SCP runs fn with a scp client and runs it again on a new connection if the
+// connection was lost, fn should be safe to run again, e.g. copy one file
+func (r *Reconnector) SCP(ctx context.Context, fn func(scp *scpClient) error) error {
+	return r.retry(ctx, func(client *ssh.Client) error {
+		scp, err := NewSCPClient(client)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			_ = scp.Close()
+		}()
+		if r.cfg.SCPSetup != nil {
+			r.cfg.SCPSetup(scp)
+		}
+		return fn(scp)
+	})
+}
+
+// CopyLocal2Remote is scpClient.CopyLocal2Remote which retries the current
+// source path after reconnecting
+func (r *Reconnector) CopyLocal2Remote(ctx context.Context, paths ...string) error {
+	if len(paths) < 2 {
+		return ErrInvalidParameter
+	}
+	remotePath := paths[len(paths)-1]
+	if len(paths) > 2 {
+		err := r.SCP(ctx, func(scp *scpClient) error {
+			remoteDirPath := scp.replaceHome(remotePath, false)
+			info, err := scp.sftpClient.Stat(remoteDirPath)
+			if err != nil {
+				return scp.pathError("stat", remoteDirPath, err)
+			}
+			if !info.IsDir() {
+				return scp.pathError("copy", remoteDirPath, ErrNotDir)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	for _, localPath := range paths[:len(paths)-1] {
+		err := r.SCP(ctx, func(scp *scpClient) error {
+			return scp.CopyLocal2Remote(localPath, remotePath)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CopyRemote2Local is scpClient.CopyRemote2Local which retries the current
+// source path after reconnecting
+func (r *Reconnector) CopyRemote2Local(ctx context.Context, paths ...string) error {
+	if len(paths) < 2 {
+		return ErrInvalidParameter
+	}
+	localPath := paths[len(paths)-1]
+	if len(paths) > 2 {
+		localDirPath, err := homedir.Expand(localPath)
+		if err != nil {
+			return err
+		}
+		info, err := os.Stat(localDirPath)
+		if err != nil {
+			return &PathError{Op: "copy", Path: localDirPath, Err: err}
+		}
+		if !info.IsDir() {
+			return &PathError{Op: "copy", Path: localDirPath, Err: ErrNotDir}
+		}
+	}
+	for _, remotePath := range paths[:len(paths)-1] {
+		err := r.SCP(ctx, func(scp *scpClient) error {
+			return scp.CopyRemote2Local(remotePath, localPath)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// records the time of the last output of a command and of the Reconnector,
+// seen is guarded by r.mu
+type lastSeenWriter struct {
+	w    io.Writer
+	r    *Reconnector
+	seen *time.Time
+}
+
+func (w *lastSeenWriter) Write(p []byte) (int, error) {
+	now := time.Now()
+	w.r.mu.Lock()
+	w.r.lastSeen = now
+	*w.seen = now
+	w.r.mu.Unlock()
+	if w.w == nil {
+		return len(p), nil
+	}
+	return w.w.Write(p)
+}
@@ -1,12 +1,14 @@
 package sshutils
 
 import (
-	"errors"
+	"context"
 	"io"
 	"os"
 	"path"
 	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 
 	"golang.org/x/crypto/ssh"
 
@@ -15,10 +17,75 @@ import (
 )
 
 type scpClient struct {
+	sshClient  *ssh.Client
 	sftpClient *sftp.Client
+	// if set, verify the checksum of every copied file
+	checksum HashAlgorithm
+	// if true, upload to a temp file and rename it over the target
+	atomic bool
+	// how to handle existing destination files
+	conflictPolicy ConflictPolicy
+	// suffix for ConflictBackup
+	backupSuffix string
+	// per transfer rate limit and the running transfer limiters
+	limitMu          sync.Mutex
+	transferRate     int
+	transferBurst    int
+	transferLimiters map[*RateLimiter]struct{}
+	// shared by all transfers of this client
+	globalLimiter *RateLimiter
+	// called while a file is transferred
+	progress ProgressFunc
+	// include/exclude patterns for directory copies
+	include []string
+	exclude []string
+	// if true, preserve modification time
+	preserve bool
+	// if true, copy directories as a tar stream over an exec session
+	tarMode     bool
+	compression Compression
+	// if true, Ensure operations only report the changes
+	checkMode bool
+	// structured event logger, default is NopLogger
+	logger Logger
+	// connection level keepalive, its error is returned if the peer is dead
+	keepAlive *KeepAlive
+	// the Conn which tracks the sftp session, nil if not opened by Conn
+	conn    *Conn
+	tracked *trackedSession
 }
 
-func (s *scpClient) CopyLocalFile2Remote(localFilePath, remotePath string) error {
+// Close closes the sftp session, the connection is not closed
+func (s *scpClient) Close() error {
+	s.conn.untrack(s.tracked)
+	return s.sftpClient.Close()
+}
+
+// SetLogger sets the event logger, nil disables logging
+func (s *scpClient) SetLogger(logger Logger) {
+	s.logger = logger
+}
+
+// SetKeepAlive sets the connection level keepalive, copies return its
+// *KeepAliveError when the connection was closed because of dead peer
+func (s *scpClient) SetKeepAlive(keepAlive *KeepAlive) {
+	s.keepAlive = keepAlive
+}
+
+func (s *scpClient) log() Logger {
+	return loggerOrNop(s.logger)
+}
+
+// SetChecksum enables post-copy checksum verification, HashNone disables it
+func (s *scpClient) SetChecksum(algo HashAlgorithm) {
+	s.checksum = algo
+}
+
+func (s *scpClient) CopyLocalFile2Remote(localFilePath, remotePath string) (err error) {
+	defer func() {
+		err = s.wrapError("copy", remotePath, true, err)
+	}()
+
 	localFilePath = s.replaceHome(localFilePath, true)
 	remotePath = s.replaceHome(remotePath, false)
 
@@ -38,49 +105,34 @@ func (s *scpClient) CopyLocalFile2Remote(localFilePath, remotePath string) error
 	remoteFileInfo, err := s.sftpClient.Stat(remotePath)
 	if err != nil {
 		// remotePath is file and not exist
-		if err != os.ErrNotExist {
+		if !isNotExist(err) {
 			return err
 		}
-	} else {
-		// remotePath is dir
-		if remoteFileInfo.IsDir() {
-			// merge path
-			filename := path.Base(localFilePath)
-			remotePath = path.Join(remotePath, filename)
-		} else { // remotePath is file
-			// remove remote file
-			err = s.sftpClient.Remove(remotePath)
-			if err != nil {
-				return err
-			}
-		}
+	} else if remoteFileInfo.IsDir() {
+		// remotePath is dir, merge path
+		filename := path.Base(localFilePath)
+		remotePath = path.Join(remotePath, filename)
 	}
 
-	// create remote file
-	remoteFile, err := s.sftpClient.Create(remotePath)
-	if err != nil {
+	// check remote file conflict
+	ok, err := s.resolveRemoteConflict(localFilePath, localFileInfo, remotePath)
+	if err != nil || !ok {
 		return err
 	}
-	defer func() {
-		_ = remoteFile.Close()
-	}()
 
 	// copy local file to remote
-	_, err = io.Copy(remoteFile, localFile)
+	err = s.writeRemote(context.Background(), localFile, remotePath, localFileInfo.Size(), localFileInfo.Mode(), localFileInfo.ModTime(), s.conflictPolicy == ConflictBackup)
 	if err != nil {
 		return err
 	}
 
-	// chmod
-	err = s.sftpClient.Chmod(remotePath, localFileInfo.Mode())
-	if err != nil {
-		return err
-	}
-
-	return nil
+	return s.verify([]transferPair{{localFilePath, remotePath}})
 }
 
-func (s *scpClient) CopyLocalDir2Remote(localDirPath, remotePath string) error {
+func (s *scpClient) CopyLocalDir2Remote(localDirPath, remotePath string) (err error) {
+	defer func() {
+		err = s.wrapError("copy", remotePath, true, err)
+	}()
 
 	localDirPath = s.replaceHome(localDirPath, true)
 	remotePath = s.replaceHome(remotePath, false)
@@ -102,7 +154,7 @@ func (s *scpClient) CopyLocalDir2Remote(localDirPath, remotePath string) error {
 	remoteInfo, err := s.sftpClient.Stat(remotePath)
 	if err != nil {
 		// remote dir not exist
-		if err == os.ErrNotExist {
+		if isNotExist(err) {
 			// create remote dir
 			err = s.sftpClient.Mkdir(remotePath)
 			if err != nil {
@@ -122,26 +174,42 @@ func (s *scpClient) CopyLocalDir2Remote(localDirPath, remotePath string) error {
 		// to a remote file makes no sense
 		if remoteInfo.IsDir() {
 			remotePath = path.Join(remotePath, path.Base(localDirPath))
-			// if remotePath already exist, return error
-			_, err = s.sftpClient.Stat(remotePath)
+			// if remotePath already exist, merge into it if the policy allows
+			existInfo, err := s.sftpClient.Stat(remotePath)
 			if err == nil {
-				return errors.New(remotePath + " already exist")
-			}
-			// create remotePath
-			err = s.sftpClient.Mkdir(remotePath)
-			if err != nil {
-				return err
+				err = s.checkDirConflict(remotePath, existInfo, true)
+				if err != nil {
+					return err
+				}
+			} else {
+				// create remotePath
+				err = s.sftpClient.Mkdir(remotePath)
+				if err != nil {
+					return err
+				}
+				// chmod
+				err = s.sftpClient.Chmod(remotePath, localDirInfo.Mode())
+				if err != nil {
+					return err
+				}
 			}
-			// chmod
-			err = s.sftpClient.Chmod(remotePath, localDirInfo.Mode())
+		} else {
+			return s.pathError("copy", remotePath, ErrNotDir)
+		}
+	}
+
+	// bulk transfer as a tar stream, fall back to sftp if not possible
+	if s.useTarUpload() {
+		pairs, err := s.tarLocalDir2Remote(localDirPath, remotePath)
+		if err != errTarUnavailable {
 			if err != nil {
 				return err
 			}
-		} else {
-			return errors.New("remote path is not directory")
+			return s.verify(pairs)
 		}
 	}
 
+	var pairs []transferPair
 	err = filepath.Walk(localDirPath, func(path string, info os.FileInfo, err error) error {
 
 		if info == nil {
@@ -158,67 +226,66 @@ func (s *scpClient) CopyLocalDir2Remote(localDirPath, remotePath string) error {
 		// remote absolute path
 		remoteAbsolutePath := filepath.Join(remotePath, remoteRelativePath)
 
-		// check remote path state
-		_, err = s.sftpClient.Stat(remoteAbsolutePath)
-		if err != nil {
-			// remote path not exist
-			if err == os.ErrNotExist {
-				// if the local path is dir, we will create a remote directory
-				// with the same name as the local path
-				if info.IsDir() {
-					err = s.sftpClient.Mkdir(remoteAbsolutePath)
-					if err != nil {
-						return err
-					}
-					return s.sftpClient.Chmod(remoteAbsolutePath, info.Mode())
-				} else {
-					// if the local path is file, we will create a remote file
-					// with the same name as the local file
-					remoteFile, err := s.sftpClient.Create(remoteAbsolutePath)
-					if err != nil {
-						return err
-					}
-
-					// open local file
-					localFile, err := os.Open(path)
-					if err != nil {
-						return err
-					}
-					defer func() {
-						_ = localFile.Close()
-					}()
-
-					// copy
-					_, err = io.Copy(remoteFile, localFile)
-					if err != nil {
-						return err
-					}
-
-					// chmod
-					err = s.sftpClient.Chmod(remoteAbsolutePath, info.Mode())
-					if err != nil {
-						return err
-					}
-
-					_ = remoteFile.Close()
-					_ = localFile.Close()
+		// include/exclude filter
+		if s.skipped(strings.TrimPrefix(filepath.ToSlash(remoteRelativePath), "/"), info.IsDir()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
 
-				}
-			} else {
+		// if the local path is dir, we will create a remote directory
+		// with the same name as the local path
+		if info.IsDir() {
+			existInfo, err := s.sftpClient.Stat(remoteAbsolutePath)
+			if err == nil {
+				return s.checkDirConflict(remoteAbsolutePath, existInfo, true)
+			}
+			if !isNotExist(err) {
+				return err
+			}
+			err = s.sftpClient.Mkdir(remoteAbsolutePath)
+			if err != nil {
 				return err
 			}
+			return s.sftpClient.Chmod(remoteAbsolutePath, info.Mode())
+		}
+
+		// if the local path is file, we will create a remote file
+		// with the same name as the local file
+		ok, err := s.resolveRemoteConflict(path, info, remoteAbsolutePath)
+		if err != nil || !ok {
+			return err
+		}
+
+		localFile, err := os.Open(path)
+		if err != nil {
+			return err
 		}
+		defer func() {
+			_ = localFile.Close()
+		}()
 
+		// copy
+		err = s.writeRemote(context.Background(), localFile, remoteAbsolutePath, info.Size(), info.Mode(), info.ModTime(), s.conflictPolicy == ConflictBackup)
+		if err != nil {
+			return err
+		}
+
+		pairs = append(pairs, transferPair{path, remoteAbsolutePath})
 		return nil
 	})
+	if err != nil {
+		return err
+	}
 
-	return err
+	return s.verify(pairs)
 }
 
 func (s *scpClient) CopyLocal2Remote(paths ...string) error {
 
 	if len(paths) < 2 {
-		return errors.New("parameter invalid")
+		return ErrInvalidParameter
 	}
 
 	remotePath := paths[len(paths)-1]
@@ -227,10 +294,10 @@ func (s *scpClient) CopyLocal2Remote(paths ...string) error {
 	if len(paths) > 2 {
 		remoteFileInfo, err := s.sftpClient.Stat(remotePath)
 		if err != nil {
-			return err
+			return s.pathError("stat", remotePath, err)
 		}
 		if !remoteFileInfo.IsDir() {
-			return errors.New("remote path must a directory")
+			return s.pathError("copy", remotePath, ErrNotDir)
 		}
 	}
 
@@ -256,7 +323,46 @@ func (s *scpClient) CopyLocal2Remote(paths ...string) error {
 
 }
 
-func (s *scpClient) CopyRemote2Local(remotePath, localPath string) error {
+// CopyRemote2Local copies remote paths to local path, the last path is the
+// local destination and must be a directory if more than one remote path is
+// copied. Remote paths may be glob patterns, see Glob.
+func (s *scpClient) CopyRemote2Local(paths ...string) error {
+
+	if len(paths) < 2 {
+		return ErrInvalidParameter
+	}
+
+	localPath := s.replaceHome(paths[len(paths)-1], true)
+
+	remotePaths, err := s.expandRemotePaths(paths[:len(paths)-1])
+	if err != nil {
+		return err
+	}
+
+	if len(remotePaths) > 1 {
+		localInfo, err := os.Stat(localPath)
+		if err != nil {
+			return &PathError{Op: "copy", Path: localPath, Err: err}
+		}
+		if !localInfo.IsDir() {
+			return &PathError{Op: "copy", Path: localPath, Err: ErrNotDir}
+		}
+	}
+
+	for _, remotePath := range remotePaths {
+		err := s.copyRemote2Local(remotePath, localPath)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copy a remote file or directory to local path
+func (s *scpClient) copyRemote2Local(remotePath, localPath string) (err error) {
+	defer func() {
+		err = s.wrapError("copy", remotePath, true, err)
+	}()
 
 	localPath = s.replaceHome(localPath, true)
 	remotePath = s.replaceHome(remotePath, false)
@@ -284,109 +390,154 @@ func (s *scpClient) CopyRemote2Local(remotePath, localPath string) error {
 		// if local dir not exist, we will create a local dir
 		// with the same name as the remote dir
 		if localFileErr != nil {
-			if os.IsNotExist(localFileErr) {
-				err = os.MkdirAll(path.Join(localPath), remoteFileInfo.Mode())
-				if err != nil {
-					return err
-				}
+			if !isNotExist(localFileErr) {
+				return localFileErr
+			}
+			err = os.MkdirAll(localPath, remoteFileInfo.Mode())
+			if err != nil {
+				return err
 			}
 		} else {
 			// if local dir exist, we will merge local dir path and remote dir relative path
-			if localFileInfo.IsDir() {
+			if !localFileInfo.IsDir() {
+				return &PathError{Op: "copy", Path: localPath, Err: ErrExist}
+			}
+			localPath = path.Join(localPath, path.Base(remotePath))
+			existInfo, err := os.Stat(localPath)
+			if err == nil {
+				err = s.checkDirConflict(localPath, existInfo, false)
+				if err != nil {
+					return err
+				}
+			} else {
 				// create local dir
-				localPath = path.Join(localPath, path.Base(remotePath))
 				err = os.MkdirAll(localPath, remoteFileInfo.Mode())
 				if err != nil {
 					return err
 				}
-			} else {
-				return errors.New(localPath + " already exist")
 			}
 		}
 
+		// bulk transfer as a tar stream, fall back to sftp if not possible
+		if s.tarMode {
+			pairs, err := s.tarRemoteDir2Local(remotePath, localPath)
+			if err != errTarUnavailable {
+				if err != nil {
+					return err
+				}
+				return s.verify(pairs)
+			}
+		}
+
+		var pairs []transferPair
 		w := s.sftpClient.Walk(remotePath)
 		for w.Step() {
+			if w.Err() != nil {
+				return w.Err()
+			}
 
 			// skip
 			if w.Path() == remotePath {
 				continue
 			}
 
+			localFilePath := strings.Replace(w.Path(), remotePath, localPath, 1)
+
+			// include/exclude filter
+			if s.skipped(strings.TrimPrefix(strings.TrimPrefix(w.Path(), remotePath), "/"), w.Stat().IsDir()) {
+				if w.Stat().IsDir() {
+					w.SkipDir()
+				}
+				continue
+			}
+
 			// if remote path is a dir, we will create a local dir with the same
 			// name as the remote dir
 			if w.Stat().IsDir() {
-				err = os.Mkdir(strings.Replace(w.Path(), remotePath, localPath, -1), remoteFileInfo.Mode())
-				if err != nil {
-					return err
-				}
-			} else {
-				// if remote path is a file, copy it
-				localFile, err := os.OpenFile(strings.Replace(w.Path(), remotePath, localPath, 1), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, w.Stat().Mode())
-				if err != nil {
-					return err
-				}
-				remoteTmpFile, err := s.sftpClient.Open(w.Path())
-				if err != nil {
-					return err
+				existInfo, err := os.Stat(localFilePath)
+				if err == nil {
+					err = s.checkDirConflict(localFilePath, existInfo, false)
+				} else {
+					err = os.Mkdir(localFilePath, w.Stat().Mode())
 				}
-				_, err = io.Copy(localFile, remoteTmpFile)
 				if err != nil {
 					return err
 				}
-				_ = localFile.Close()
-				_ = remoteTmpFile.Close()
+				continue
 			}
-		}
-
-	} else {
-		if localFileErr != nil {
-			// if remote path is a file and local file not exist, we will create a local
-			// file with the same name as the remote file
-			if os.IsNotExist(localFileErr) {
-				localFile, err := os.OpenFile(localPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, remoteFileInfo.Mode())
-				if err != nil {
-					return err
-				}
-				defer func() {
-					_ = localFile.Close()
-				}()
 
-				// copy remote file to local file
-				_, err = io.Copy(localFile, remoteFile)
-				if err != nil {
-					return err
-				}
-			} else {
+			// if remote path is a file, copy it
+			ok, err := s.resolveLocalConflict(w.Path(), w.Stat(), localFilePath)
+			if err != nil {
 				return err
 			}
-		} else {
-
-			// if remote path is a file and local path is a dir, merge remote file name
-			// to local path
-			if localFileInfo.IsDir() {
-				localPath = path.Join(localPath, path.Base(remotePath))
-			} else {
-				// if local file already exist, remove it
-				err = os.Remove(localPath)
-				if err != nil {
-					return err
-				}
+			if !ok {
+				continue
 			}
-
-			localFile, err := os.OpenFile(localPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, remoteFileInfo.Mode())
+			remoteTmpFile, err := s.sftpClient.Open(w.Path())
 			if err != nil {
 				return err
 			}
-			defer func() {
-				_ = localFile.Close()
-			}()
-			_, err = io.Copy(localFile, remoteFile)
+			err = s.writeLocal(context.Background(), remoteTmpFile, localFilePath, w.Stat().Size(), w.Stat().Mode(), w.Stat().ModTime())
+			_ = remoteTmpFile.Close()
 			if err != nil {
 				return err
 			}
+
+			pairs = append(pairs, transferPair{localFilePath, w.Path()})
 		}
+
+		return s.verify(pairs)
+	}
+
+	// if remote path is a file and local path is a dir, merge remote file name
+	// to local path
+	if localFileErr == nil && localFileInfo.IsDir() {
+		localPath = path.Join(localPath, path.Base(remotePath))
+	} else if localFileErr != nil && !isNotExist(localFileErr) {
+		return localFileErr
+	}
+
+	// check local file conflict
+	ok, err := s.resolveLocalConflict(remotePath, remoteFileInfo, localPath)
+	if err != nil || !ok {
+		return err
+	}
+
+	// copy remote file to local file
+	err = s.writeLocal(context.Background(), remoteFile, localPath, remoteFileInfo.Size(), remoteFileInfo.Mode(), remoteFileInfo.ModTime())
+	if err != nil {
+		return err
 	}
+	return s.verify([]transferPair{{localPath, remotePath}})
+}
 
+// write r to local path, mtime is applied in preserve mode and when not zero,
+// size is only used for progress and may be -1
+func (s *scpClient) writeLocal(ctx context.Context, r io.Reader, localPath string, size int64, mode os.FileMode, mtime time.Time) error {
+	localFile, err := os.OpenFile(localPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = localFile.Close()
+	}()
+
+	r, done := s.wrapReader(ctx, r, localPath, size)
+	defer done()
+
+	_, err = io.Copy(localFile, r)
+	if err != nil {
+		return err
+	}
+	err = localFile.Close()
+	if err != nil {
+		return err
+	}
+
+	if s.preserve && !mtime.IsZero() {
+		return os.Chtimes(localPath, mtime, mtime)
+	}
 	return nil
 }
 
@@ -422,6 +573,9 @@ func NewSCPClient(client *ssh.Client) (*scpClient, error) {
 		return nil, err
 	}
 	return &scpClient{
-		sftpClient: sftpClient,
+		sshClient:        client,
+		sftpClient:       sftpClient,
+		transferLimiters: make(map[*RateLimiter]struct{}),
+		globalLimiter:    NewRateLimiter(0, 0),
 	}, nil
 }
@@ -0,0 +1,77 @@
+package sshutils
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// local signals forwarded to the remote command of PipeExec
+var forwardedSignals = []os.Signal{syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT, syscall.SIGHUP}
+
+// ssh signal names of RFC 4254
+var sshSignals = map[os.Signal]ssh.Signal{
+	syscall.SIGABRT: ssh.SIGABRT,
+	syscall.SIGALRM: ssh.SIGALRM,
+	syscall.SIGFPE:  ssh.SIGFPE,
+	syscall.SIGHUP:  ssh.SIGHUP,
+	syscall.SIGILL:  ssh.SIGILL,
+	syscall.SIGINT:  ssh.SIGINT,
+	syscall.SIGKILL: ssh.SIGKILL,
+	syscall.SIGPIPE: ssh.SIGPIPE,
+	syscall.SIGQUIT: ssh.SIGQUIT,
+	syscall.SIGSEGV: ssh.SIGSEGV,
+	syscall.SIGTERM: ssh.SIGTERM,
+	syscall.SIGUSR1: ssh.SIGUSR1,
+	syscall.SIGUSR2: ssh.SIGUSR2,
+}
+
+// forward local SIGINT, SIGTERM, SIGQUIT and SIGHUP to the remote command
+// of PipeExec, the session is closed if the command is still running grace
+// after the first signal, because servers may ignore signal requests;
+// 0 disables forwarding
+func (s *SSHSession) SetSignalForwarding(grace time.Duration) {
+	s.signalGrace = grace
+}
+
+// send a signal to the running remote command
+func (s *SSHSession) Signal(sig ssh.Signal) error {
+	err := s.session.Signal(sig)
+	if err != nil {
+		s.log().Warn("send signal failed", "signal", string(sig), "error", err)
+		return err
+	}
+	s.log().Info("signal sent", "signal", string(sig))
+	return nil
+}
+
+// forward the local signals until done is closed
+func (s *SSHSession) forwardSignals(done <-chan struct{}) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, forwardedSignals...)
+
+	go func() {
+		defer signal.Stop(sigs)
+		var grace <-chan time.Time
+		for {
+			select {
+			case <-done:
+				return
+			case sig := <-sigs:
+				_ = s.Signal(sshSignals[sig])
+				if grace == nil {
+					timer := time.NewTimer(s.signalGrace)
+					defer timer.Stop()
+					grace = timer.C
+				}
+			case <-grace:
+				s.log().Warn("remote command still running after signal, closing session", "grace", s.signalGrace)
+				_ = s.session.Close()
+				return
+			}
+		}
+	}()
+}
@@ -4,12 +4,9 @@ import (
 	"fmt"
 	"io"
 	"os"
-	"os/signal"
-	"syscall"
+	"sync"
 	"time"
 
-	"golang.org/x/crypto/ssh/terminal"
-
 	"golang.org/x/crypto/ssh"
 )
 
@@ -35,9 +32,91 @@ type SSHSession struct {
 	// delay the specified time execution command when automatically
 	// switching the root user to ensure that terminal stdout outputs correctly
 	cmdDelay time.Duration
-	Stdout   io.Reader
-	Stdin    io.Writer
-	Stderr   io.Reader
+	// limit the PipeExec output stream
+	limiter *RateLimiter
+	// structured event logger, default is NopLogger
+	logger Logger
+	// connection level keepalive, its error is returned if the peer is dead
+	keepAlive *KeepAlive
+	// max missed keepalive replies of TerminalWithKeepAlive
+	serverAliveCountMax int
+	// pty options merged over DefaultPtyOptions
+	ptyOptions *PtyOptions
+	// escape character of TerminalWithKeepAlive, 0 is '~'
+	escapeChar int
+	// the connection, required by port forwards
+	client *ssh.Client
+	// port forwards added by the escape command line
+	forwardsMu sync.Mutex
+	forwards   []*PortForward
+	// stdin of PipeExec, nil sends EOF immediately
+	stdin io.Reader
+	// if true, PipeExec does not request a pty
+	noPty bool
+	// if true, PipeExec requests a pty even if stdin is set
+	forcePty bool
+	// grace period of PipeExec signal forwarding, 0 disables forwarding
+	signalGrace time.Duration
+	// the Conn which tracks the session, nil if not opened by Conn
+	conn    *Conn
+	tracked *trackedSession
+	Stdout  io.Reader
+	Stdin   io.Writer
+	Stderr  io.Reader
+}
+
+// limit the PipeExec output stream, the limiter can be shared with other
+// sessions or a scp client
+func (s *SSHSession) SetRateLimiter(limiter *RateLimiter) {
+	s.limiter = limiter
+}
+
+// set the event logger, nil disables logging
+func (s *SSHSession) SetLogger(logger Logger) {
+	s.logger = logger
+}
+
+// set the connection level keepalive, terminal and exec return its
+// *KeepAliveError when the connection was closed because of dead peer
+func (s *SSHSession) SetKeepAlive(keepAlive *KeepAlive) {
+	s.keepAlive = keepAlive
+}
+
+// set the max missed keepalive replies of TerminalWithKeepAlive before
+// closing the session, default is 3
+func (s *SSHSession) SetServerAliveCountMax(countMax int) {
+	s.serverAliveCountMax = countMax
+}
+
+// set the pty options of TerminalWithKeepAlive and PipeExec, non-zero
+// fields override the options derived from the local terminal
+func (s *SSHSession) SetPtyOptions(opts *PtyOptions) {
+	s.ptyOptions = opts
+}
+
+// set the stdin of PipeExec, PipeExec does not request a pty unless
+// SetRequestPty(true) is called, so binary data and long lines reach the
+// remote command unchanged. EOF of r is sent to the remote command: without
+// a pty the write side of the session is closed, with a pty VEOF (^D) is
+// written because the pty ignores it. The pty echo is disabled unless ECHO
+// is set by SetPtyOptions; the pty input is line based, so binary data or
+// lines longer than the pty line buffer (4096 bytes on Linux) are mangled.
+// A blocked read of r is interrupted when the command exits if r has a
+// SetReadDeadline method, e.g. *os.File or net.Conn
+func (s *SSHSession) SetStdin(r io.Reader) {
+	s.stdin = r
+}
+
+// set whether PipeExec requests a pty, default is true unless stdin is set;
+// without a pty stderr is not merged by the remote side and Ctrl-C is not
+// sent as ^C
+func (s *SSHSession) SetRequestPty(request bool) {
+	s.noPty = !request
+	s.forcePty = request
+}
+
+func (s *SSHSession) log() Logger {
+	return loggerOrNop(s.logger)
 }
 
 func (s *SSHSession) Ready() <-chan int {
@@ -50,7 +129,7 @@ func (s *SSHSession) Close() error {
 	if ok {
 		err := pw.Close()
 		if err != nil {
-			fmt.Println(err)
+			s.log().Warn("close stdout pipe failed", "error", err)
 		}
 	}
 
@@ -58,41 +137,23 @@ func (s *SSHSession) Close() error {
 	if ok {
 		err := pr.Close()
 		if err != nil {
-			fmt.Println(err)
+			s.log().Warn("close stdin pipe failed", "error", err)
 		}
 	}
+	s.log().Debug("session closed")
+	s.conn.untrack(s.tracked)
 	return s.session.Close()
 }
 
-// update shell terminal size in background
-func (s *SSHSession) updateTerminalSize() {
-	go func() {
-		// SIGWINCH is sent to the process when the window size of the terminal has changed.
-		sigs := make(chan os.Signal)
-		signal.Notify(sigs, syscall.SIGWINCH)
-
-		fd := int(os.Stdin.Fd())
-		termWidth, termHeight, err := terminal.GetSize(fd)
-		if err != nil {
-			fmt.Println(err)
-		}
-
-		for range sigs {
-			currTermWidth, currTermHeight, err := terminal.GetSize(fd)
-			// Terminal size has not changed, don's do anything.
-			if currTermHeight == termHeight && currTermWidth == termWidth {
-				continue
-			}
-
-			// The client updated the size of the local PTY. This change needs to occur on the server side PTY as well.
-			err = s.session.WindowChange(currTermHeight, currTermWidth)
-			if err != nil {
-				fmt.Printf("Unable to send window-change reqest: %s", err)
-				continue
-			}
-			termWidth, termHeight = currTermWidth, currTermHeight
-		}
-	}()
+// request pty by the options
+func (s *SSHSession) requestPty(opts *PtyOptions) error {
+	err := requestPty(s.session, opts)
+	if err != nil {
+		s.log().Error("request pty failed", "term", opts.Term, "error", err)
+		return err
+	}
+	s.log().Debug("pty allocated", "term", opts.Term, "width", opts.Width, "height", opts.Height)
+	return nil
 }
 
 func (s *SSHSession) ShellDone() <-chan int {
@@ -114,35 +175,42 @@ func (s *SSHSession) TerminalWithKeepAlive(serverAliveInterval time.Duration) er
 		}
 	}()
 
-	fd := int(os.Stdin.Fd())
-	state, err := terminal.MakeRaw(fd)
-	if err != nil {
-		return err
-	}
-	defer func() {
-		_ = terminal.Restore(fd, state)
-	}()
+	// the terminal modes must be read before switching to raw mode
+	ptyOptions := s.ptyOptions.merge(DefaultPtyOptions(int(os.Stdin.Fd())))
 
-	// get terminal size
-	termWidth, termHeight, err := terminal.GetSize(fd)
+	tio, restore, err := OSTerminal()
 	if err != nil {
 		return err
 	}
+	defer restore()
 
-	// default to xterm-256color
-	termType := os.Getenv("TERM")
-	if termType == "" {
-		termType = "xterm-256color"
-	}
+	return s.terminal(tio, ptyOptions, serverAliveInterval)
+}
+
+// open a interactive shell over tio with keepalive, the pty size is set by
+// SetPtyOptions and defaults to 80x24
+func (s *SSHSession) TerminalWithIO(tio *TerminalIO, serverAliveInterval time.Duration) error {
+	return s.terminal(tio, s.ptyOptions.merge(DefaultPtyOptions(-1)), serverAliveInterval)
+}
 
+func (s *SSHSession) terminal(tio *TerminalIO, ptyOptions *PtyOptions, serverAliveInterval time.Duration) error {
+	s.conn.update(s.tracked, "terminal", "", SessionRunning, nil)
+	err := s.runTerminal(tio, ptyOptions, serverAliveInterval)
+	s.conn.update(s.tracked, "", "", SessionExited, err)
+	return err
+}
+
+func (s *SSHSession) runTerminal(tio *TerminalIO, ptyOptions *PtyOptions, serverAliveInterval time.Duration) error {
 	// request pty
-	err = s.session.RequestPty(termType, termHeight, termWidth, ssh.TerminalModes{})
+	err := s.requestPty(ptyOptions)
 	if err != nil {
 		return err
 	}
 
 	// update shell terminal size in background
-	s.updateTerminalSize()
+	doneCh := make(chan struct{})
+	defer close(doneCh)
+	s.watchResize(tio.Resize, doneCh)
 
 	// get pipe stdin
 	s.Stdin, err = s.session.StdinPipe()
@@ -159,25 +227,42 @@ func (s *SSHSession) TerminalWithKeepAlive(serverAliveInterval time.Duration) er
 	// get pipe stderr
 	s.Stderr, err = s.session.StderrPipe()
 
-	// async copy
+	// stdout and stderr are copied concurrently, serialize them if they share the writer
+	stdout, stderr := tio.Out, tio.Err
+	if stderr == nil {
+		stdout = &lockedWriter{w: tio.Out}
+		stderr = stdout
+	}
+
+	// async copy, the output is flushed before returning
+	var copyWg sync.WaitGroup
+	copyWg.Add(2)
 	go func() {
-		_, _ = io.Copy(os.Stderr, s.Stderr)
+		defer copyWg.Done()
+		_, _ = io.Copy(stderr, s.Stderr)
 	}()
 	go func() {
-		_, _ = io.Copy(os.Stdout, s.Stdout)
+		defer copyWg.Done()
+		_, _ = io.Copy(stdout, s.Stdout)
 	}()
+	escape := s.newEscapeHandler(tio.Out, tio.Suspend)
+	defer s.closeForwards()
 	go func() {
 		buf := make([]byte, 128)
 		for {
-			n, err := os.Stdin.Read(buf)
+			n, err := tio.In.Read(buf)
 			if err != nil {
-				fmt.Println(err)
+				s.log().Warn("read stdin failed", "error", err)
 				return
 			}
-			if n > 0 {
-				_, err = s.Stdin.Write(buf[:n])
+			data := buf[:n]
+			if escape != nil {
+				data = escape.filter(data)
+			}
+			if len(data) > 0 {
+				_, err = s.Stdin.Write(data)
 				if err != nil {
-					fmt.Println(err)
+					s.log().Warn("write remote stdin failed", "error", err)
 					s.exitMsg = err.Error()
 					return
 				}
@@ -185,24 +270,23 @@ func (s *SSHSession) TerminalWithKeepAlive(serverAliveInterval time.Duration) er
 		}
 	}()
 
-	// keepalive
+	// keepalive, the session is closed if the server stops answering
+	var sessionKeepAlive *KeepAlive
 	if serverAliveInterval > 0 {
-		go func() {
-			tick := time.Tick(serverAliveInterval)
-			for range tick {
-				_, err := s.session.SendRequest("keepalive@linux.com", true, nil)
-				if err != nil {
-					fmt.Println(err)
-				}
-			}
-		}()
+		sessionKeepAlive = startKeepAlive("", serverAliveInterval, s.serverAliveCountMax, s.logger, func() error {
+			_, err := s.session.SendRequest("keepalive@openssh.com", true, nil)
+			return err
+		}, s.session.Close)
+		defer sessionKeepAlive.Stop()
 	}
 
 	// open shell
 	err = s.session.Shell()
 	if err != nil {
-		return err
+		s.log().Error("start shell failed", "error", err)
+		return s.keepAlive.wrap(err)
 	}
+	s.log().Info("shell started")
 	s.shellDoneCh <- 1
 
 	// auto switch root user
@@ -249,32 +333,54 @@ func (s *SSHSession) TerminalWithKeepAlive(serverAliveInterval time.Duration) er
 			}
 		}()
 	}
-	return s.session.Wait()
+	err = s.session.Wait()
+	copyWg.Wait()
+	if escape != nil && escape.disconnected {
+		return nil
+	}
+	return s.keepAlive.wrap(sessionKeepAlive.wrap(err))
 }
 
 // pipe exec
 func (s *SSHSession) PipeExec(cmd string) error {
 	fd := int(os.Stdin.Fd())
-	termWidth, termHeight, err := terminal.GetSize(fd)
-	if err != nil {
-		return err
-	}
+	doneCh := make(chan struct{})
+	defer close(doneCh)
+
+	var veof byte
+	if !s.noPty && (s.stdin == nil || s.forcePty) {
+		// request pty
+		def := DefaultPtyOptions(fd)
+		if s.stdin != nil {
+			// do not echo the input to the output
+			def.Modes[ssh.ECHO] = 0
+		}
+		ptyOptions := s.ptyOptions.merge(def)
+		err := s.requestPty(ptyOptions)
+		if err != nil {
+			return err
+		}
+		veof = byte(ptyOptions.Modes[ssh.VEOF])
+		if veof == 0 {
+			veof = 4
+		}
 
-	// default to xterm-256color
-	termType := os.Getenv("TERM")
-	if termType == "" {
-		termType = "xterm-256color"
+		// update shell terminal size in background
+		resize, stopResize := osResizeEvents(fd)
+		defer stopResize()
+		s.watchResize(resize, doneCh)
 	}
 
-	// request pty
-	err = s.session.RequestPty(termType, termHeight, termWidth, ssh.TerminalModes{})
-	if err != nil {
-		return err
+	var stdin io.WriteCloser
+	if s.stdin != nil {
+		var err error
+		stdin, err = s.session.StdinPipe()
+		if err != nil {
+			return err
+		}
+		s.Stdin = stdin
 	}
 
-	// update shell terminal size in background
-	s.updateTerminalSize()
-
 	// write to pw
 	pr, pw := io.Pipe()
 	defer func() {
@@ -284,12 +390,101 @@ func (s *SSHSession) PipeExec(cmd string) error {
 
 	s.session.Stdout = pw
 	s.session.Stderr = pw
-	s.Stdout = pr
-	s.Stderr = pr
+	s.Stdout = NewRateLimitedReader(pr, s.limiter)
+	s.Stderr = s.Stdout
 
 	s.readyCh <- 1
 
-	return s.session.Run(cmd)
+	if s.signalGrace > 0 {
+		s.forwardSignals(doneCh)
+	}
+
+	s.log().Info("exec started", "cmd", cmd)
+	s.conn.update(s.tracked, "exec", cmd, SessionRunning, nil)
+	err := s.session.Start(cmd)
+	if err == nil && stdin != nil {
+		// the input is sent after the command started
+		stopCh := make(chan struct{})
+		copyDone := make(chan struct{})
+		go func() {
+			defer close(copyDone)
+			s.copyStdin(stdin, veof, stopCh)
+		}()
+		err = s.session.Wait()
+		close(stopCh)
+		s.stopStdin(copyDone)
+	} else if err == nil {
+		err = s.session.Wait()
+	}
+	err = s.keepAlive.wrap(newRemoteExitError(s.host(), cmd, "", err))
+	s.conn.update(s.tracked, "", "", SessionExited, err)
+	s.log().Info("exec finished", "cmd", cmd, "error", err)
+	return err
+}
+
+// copy stdin to the remote command and send EOF, veof is the VEOF character
+// of the pty or 0 without a pty; stopCh is closed when the command exited
+func (s *SSHSession) copyStdin(stdin io.WriteCloser, veof byte, stopCh <-chan struct{}) {
+	defer func() {
+		_ = stdin.Close()
+	}()
+	w := &lastByteWriter{w: stdin}
+	_, err := io.Copy(w, s.stdin)
+	if err != nil {
+		select {
+		case <-stopCh:
+			// the command exited, the input is not needed
+		default:
+			s.log().Warn("copy stdin failed", "error", err)
+		}
+		return
+	}
+	if veof == 0 {
+		return
+	}
+	// VEOF sends a pending line, the second one on an empty line is EOF
+	eof := []byte{veof}
+	if w.n > 0 && w.last != '\n' {
+		eof = append(eof, veof)
+	}
+	_, err = stdin.Write(eof)
+	if err != nil {
+		s.log().Warn("write stdin eof failed", "error", err)
+	}
+}
+
+// stop the stdin copier after the command exited, a blocked read of stdin
+// is interrupted if the reader supports read deadlines; otherwise the
+// copier stops after its next read, because the session is closed
+func (s *SSHSession) stopStdin(copyDone <-chan struct{}) {
+	select {
+	case <-copyDone:
+		return
+	default:
+	}
+	d, ok := s.stdin.(interface{ SetReadDeadline(time.Time) error })
+	if !ok || d.SetReadDeadline(time.Now()) != nil {
+		return
+	}
+	<-copyDone
+	// keep the reader usable for the caller
+	_ = d.SetReadDeadline(time.Time{})
+}
+
+// lastByteWriter remembers the last written byte
+type lastByteWriter struct {
+	w    io.Writer
+	n    int64
+	last byte
+}
+
+func (l *lastByteWriter) Write(p []byte) (int, error) {
+	n, err := l.w.Write(p)
+	if n > 0 {
+		l.n += int64(n)
+		l.last = p[n-1]
+	}
+	return n, err
 }
 
 // New Session
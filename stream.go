@@ -0,0 +1,103 @@
+package sshutils
+
+import (
+	"context"
+	"io"
+	"os"
+	"time"
+)
+
+// ProgressFunc is called while a file is transferred, name is the destination
+// path and total is -1 if the size is unknown
+type ProgressFunc func(name string, transferred, total int64)
+
+// SetProgress sets the transfer progress callback, nil disables it
+func (s *scpClient) SetProgress(fn ProgressFunc) {
+	s.progress = fn
+}
+
+// progressReader reports progress and stops reading when ctx is done
+type progressReader struct {
+	ctx         context.Context
+	r           io.Reader
+	name        string
+	total       int64
+	transferred int64
+	progress    ProgressFunc
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	err := r.ctx.Err()
+	if err != nil {
+		return 0, err
+	}
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.transferred += int64(n)
+		if r.progress != nil {
+			r.progress(r.name, r.transferred, r.total)
+		}
+	}
+	return n, err
+}
+
+// wrap r with context, progress and rate limit, done must be called
+// when the transfer finished
+func (s *scpClient) wrapReader(ctx context.Context, r io.Reader, name string, total int64) (io.Reader, func()) {
+	l, limiterDone := s.newTransferLimiter()
+	pr := &progressReader{
+		ctx:      ctx,
+		r:        r,
+		name:     name,
+		total:    total,
+		progress: s.progress,
+	}
+
+	start := time.Now()
+	s.log().Info("transfer started", "host", s.host(), "path", name, "size", total)
+	done := func() {
+		limiterDone()
+		s.log().Info("transfer finished", "host", s.host(), "path", name, "bytes", pr.transferred, "elapsed", time.Since(start))
+	}
+	return NewRateLimitedReader(pr, l, s.globalLimiter), done
+}
+
+// Upload writes the content of r to remote file, the remote file is created
+// or truncated and uses the atomic mode if enabled
+func (s *scpClient) Upload(ctx context.Context, r io.Reader, remotePath string, mode os.FileMode) error {
+	remotePath = s.replaceHome(remotePath, false)
+
+	remoteInfo, err := s.sftpClient.Stat(remotePath)
+	if err == nil && remoteInfo.IsDir() {
+		return s.pathError("upload", remotePath, ErrIsDir)
+	}
+
+	return s.wrapError("upload", remotePath, true, s.writeRemote(ctx, r, remotePath, -1, mode, time.Time{}, false))
+}
+
+// Download writes the content of remote file to w
+func (s *scpClient) Download(ctx context.Context, remotePath string, w io.Writer) error {
+	remotePath = s.replaceHome(remotePath, false)
+
+	remoteFile, err := s.sftpClient.Open(remotePath)
+	if err != nil {
+		return s.wrapError("download", remotePath, true, err)
+	}
+	defer func() {
+		_ = remoteFile.Close()
+	}()
+
+	remoteInfo, err := remoteFile.Stat()
+	if err != nil {
+		return s.wrapError("download", remotePath, true, err)
+	}
+	if remoteInfo.IsDir() {
+		return s.pathError("download", remotePath, ErrIsDir)
+	}
+
+	r, done := s.wrapReader(ctx, remoteFile, remotePath, remoteInfo.Size())
+	defer done()
+
+	_, err = io.Copy(w, r)
+	return s.wrapError("download", remotePath, true, err)
+}
@@ -0,0 +1,495 @@
+package sshutils
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression of the tar stream used by the tar mode
+type Compression int
+
+const (
+	CompressionNone Compression = iota
+	CompressionGzip
+	CompressionZstd
+)
+
+// remote commands needed by the compression
+func (c Compression) commands() []string {
+	switch c {
+	case CompressionGzip:
+		return []string{"tar", "gzip"}
+	case CompressionZstd:
+		return []string{"tar", "zstd"}
+	default:
+		return []string{"tar"}
+	}
+}
+
+var errTarUnavailable = errors.New("tar is not available on the remote host")
+
+// SetTarMode enables copying directories as a tar stream over an exec session
+// instead of per file sftp requests, it falls back to sftp if `tar` (or the
+// compression command) is not available on the remote host; uploads also fall
+// back in atomic mode or with a conflict policy other than ConflictOverwrite,
+// because the remote tar can only overwrite files
+func (s *scpClient) SetTarMode(enabled bool, compression Compression) {
+	s.tarMode = enabled
+	s.compression = compression
+}
+
+// check the tar mode can be used for uploading
+func (s *scpClient) useTarUpload() bool {
+	return s.tarMode && !s.atomic && s.conflictPolicy == ConflictOverwrite
+}
+
+// check all commands exist on the remote host
+func (s *scpClient) remoteHasCommands(cmds ...string) bool {
+	session, err := s.sshClient.NewSession()
+	if err != nil {
+		return false
+	}
+	defer func() {
+		_ = session.Close()
+	}()
+
+	var checks []string
+	for _, cmd := range cmds {
+		checks = append(checks, "command -v "+cmd+" >/dev/null 2>&1")
+	}
+	return session.Run(strings.Join(checks, " && ")) == nil
+}
+
+// upload local dir content into an existing remote dir as a tar stream
+func (s *scpClient) tarLocalDir2Remote(localDirPath, remoteDirPath string) ([]transferPair, error) {
+	if !s.remoteHasCommands(s.compression.commands()...) {
+		s.log().Warn("tar not available, fall back to sftp", "host", s.host())
+		return nil, errTarUnavailable
+	}
+
+	// -o: don't restore owner, -p: restore permissions, -m: don't restore mtime
+	extract := "tar -x -o -p -f -"
+	if !s.preserve {
+		extract = "tar -x -o -p -m -f -"
+	}
+	switch s.compression {
+	case CompressionGzip:
+		extract = "gzip -d -c | " + extract
+	case CompressionZstd:
+		extract = "zstd -d -c | " + extract
+	}
+
+	session, err := s.sshClient.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = session.Close()
+	}()
+
+	pr, pw := io.Pipe()
+	stdin, done := s.wrapReader(context.Background(), pr, remoteDirPath, -1)
+	defer done()
+	session.Stdin = stdin
+	var stderr bytes.Buffer
+	session.Stderr = &stderr
+
+	type result struct {
+		pairs []transferPair
+		err   error
+	}
+	resultCh := make(chan result, 1)
+	go func() {
+		pairs, err := s.writeTar(pw, localDirPath, remoteDirPath)
+		_ = pw.CloseWithError(err)
+		resultCh <- result{pairs, err}
+	}()
+
+	cmd := "cd " + ShellQuote(remoteDirPath) + " && " + extract
+	err = session.Run(cmd)
+	// unblock the tar writer if the remote side exited early
+	_ = pr.Close()
+	res := <-resultCh
+	if res.err != nil && res.err != io.ErrClosedPipe {
+		return nil, res.err
+	}
+	if err != nil {
+		return nil, newRemoteExitError(s.host(), cmd, stderr.String(), err)
+	}
+	return res.pairs, nil
+}
+
+// write local dir content as a tar stream to w
+func (s *scpClient) writeTar(w io.Writer, localDirPath, remoteDirPath string) ([]transferPair, error) {
+	var cw io.WriteCloser
+	var err error
+	switch s.compression {
+	case CompressionGzip:
+		cw = gzip.NewWriter(w)
+	case CompressionZstd:
+		cw, err = zstd.NewWriter(w)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		cw = nopWriteCloser{w}
+	}
+	tw := tar.NewWriter(cw)
+
+	var pairs []transferPair
+	err = filepath.Walk(localDirPath, func(p string, info os.FileInfo, err error) error {
+		if info == nil {
+			return err
+		}
+
+		// skip
+		if p == localDirPath {
+			return nil
+		}
+
+		rel, err := filepath.Rel(localDirPath, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		// include/exclude filter
+		if s.skipped(rel, info.IsDir()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		var link string
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err = os.Readlink(p)
+			if err != nil {
+				return err
+			}
+		case info.IsDir(), info.Mode().IsRegular():
+		default:
+			// sockets, devices and pipes are not copied
+			return nil
+		}
+
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = rel
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+		err = tw.WriteHeader(hdr)
+		if err != nil {
+			return err
+		}
+
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			_ = f.Close()
+		}()
+		_, err = io.Copy(tw, f)
+		if err != nil {
+			return err
+		}
+		pairs = append(pairs, transferPair{p, path.Join(remoteDirPath, rel)})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = tw.Close()
+	if err != nil {
+		return nil, err
+	}
+	return pairs, cw.Close()
+}
+
+// download remote dir content into an existing local dir as a tar stream
+func (s *scpClient) tarRemoteDir2Local(remoteDirPath, localDirPath string) ([]transferPair, error) {
+	if !s.remoteHasCommands(s.compression.commands()...) {
+		s.log().Warn("tar not available, fall back to sftp", "host", s.host())
+		return nil, errTarUnavailable
+	}
+
+	create := "tar -c -f - ."
+	switch s.compression {
+	case CompressionGzip:
+		create += " | gzip -c"
+	case CompressionZstd:
+		create += " | zstd -c"
+	}
+
+	session, err := s.sshClient.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = session.Close()
+	}()
+
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	var stderr bytes.Buffer
+	session.Stderr = &stderr
+
+	cmd := "cd " + ShellQuote(remoteDirPath) + " && " + create
+	err = session.Start(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	r, done := s.wrapReader(context.Background(), stdout, localDirPath, -1)
+	defer done()
+
+	pairs, err := s.readTar(r, remoteDirPath, localDirPath)
+	if err != nil {
+		return nil, err
+	}
+
+	// drain the trailing padding
+	_, _ = io.Copy(ioutil.Discard, stdout)
+	err = session.Wait()
+	if err != nil {
+		return nil, newRemoteExitError(s.host(), cmd, stderr.String(), err)
+	}
+	return pairs, nil
+}
+
+// extract the tar stream r into local dir
+func (s *scpClient) readTar(r io.Reader, remoteDirPath, localDirPath string) ([]transferPair, error) {
+	switch s.compression {
+	case CompressionGzip:
+		gr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		defer func() {
+			_ = gr.Close()
+		}()
+		r = gr
+	case CompressionZstd:
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		r = zr
+	}
+	tr := tar.NewReader(r)
+
+	var pairs []transferPair
+	var skippedDirs []string
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		name := path.Clean(hdr.Name)
+		if name == "." {
+			continue
+		}
+		// refuse paths escaping the destination
+		if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return nil, errors.New("invalid path in tar stream: " + hdr.Name)
+		}
+
+		// include/exclude filter, children of skipped dirs are skipped too
+		isDir := hdr.Typeflag == tar.TypeDir
+		if hasPathPrefix(name, skippedDirs) {
+			continue
+		}
+		if s.skipped(name, isDir) {
+			if isDir {
+				skippedDirs = append(skippedDirs, name)
+			}
+			continue
+		}
+
+		// refuse writing through symlinks created by earlier entries
+		err = checkTarParents(localDirPath, name)
+		if err != nil {
+			return nil, err
+		}
+		localFilePath := filepath.Join(localDirPath, filepath.FromSlash(name))
+		remoteFilePath := path.Join(remoteDirPath, name)
+		info := hdr.FileInfo()
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			existInfo, err := os.Stat(localFilePath)
+			if err == nil {
+				err = s.checkDirConflict(localFilePath, existInfo, false)
+			} else {
+				err = os.MkdirAll(localFilePath, info.Mode().Perm())
+			}
+			if err != nil {
+				return nil, err
+			}
+		case tar.TypeReg:
+			ok, err := s.resolveLocalConflict(remoteFilePath, info, localFilePath)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				continue
+			}
+			err = removeLocalSymlink(localFilePath)
+			if err != nil {
+				return nil, err
+			}
+			err = writeTarFile(tr, localFilePath, info)
+			if err != nil {
+				return nil, err
+			}
+			if s.preserve {
+				err = os.Chtimes(localFilePath, hdr.ModTime, hdr.ModTime)
+				if err != nil {
+					return nil, err
+				}
+			}
+			pairs = append(pairs, transferPair{localFilePath, remoteFilePath})
+		case tar.TypeSymlink:
+			_, err := os.Lstat(localFilePath)
+			if err == nil {
+				if s.conflictPolicy != ConflictOverwrite {
+					continue
+				}
+				err = os.Remove(localFilePath)
+				if err != nil {
+					return nil, err
+				}
+			}
+			err = os.Symlink(hdr.Linkname, localFilePath)
+			if err != nil {
+				return nil, err
+			}
+		case tar.TypeLink:
+			// hard link to an earlier entry of the stream
+			target := path.Clean(hdr.Linkname)
+			if path.IsAbs(target) || target == ".." || strings.HasPrefix(target, "../") {
+				return nil, errors.New("invalid link in tar stream: " + hdr.Name + " -> " + hdr.Linkname)
+			}
+			err = checkTarParents(localDirPath, target)
+			if err != nil {
+				return nil, err
+			}
+			targetPath := filepath.Join(localDirPath, filepath.FromSlash(target))
+			targetInfo, err := os.Lstat(targetPath)
+			if err != nil {
+				return nil, err
+			}
+			if !targetInfo.Mode().IsRegular() {
+				return nil, errors.New("invalid link in tar stream: " + hdr.Name + " -> " + hdr.Linkname)
+			}
+			ok, err := s.resolveLocalConflict(remoteFilePath, targetInfo, localFilePath)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				continue
+			}
+			_, err = os.Lstat(localFilePath)
+			if err == nil {
+				err = os.Remove(localFilePath)
+				if err != nil {
+					return nil, err
+				}
+			}
+			err = os.Link(targetPath, localFilePath)
+			if err != nil {
+				return nil, err
+			}
+			pairs = append(pairs, transferPair{localFilePath, remoteFilePath})
+		}
+	}
+	return pairs, nil
+}
+
+// check the parents of the tar entry name inside localDirPath are not symlinks
+func checkTarParents(localDirPath, name string) error {
+	p := localDirPath
+	parts := strings.Split(name, "/")
+	for _, part := range parts[:len(parts)-1] {
+		p = filepath.Join(p, part)
+		info, err := os.Lstat(p)
+		if err != nil {
+			if isNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return errors.New("invalid path in tar stream: " + name + ": parent is a symlink")
+		}
+	}
+	return nil
+}
+
+// remove localPath if it is a symlink, so it is not written through
+func removeLocalSymlink(localPath string) error {
+	info, err := os.Lstat(localPath)
+	if err != nil || info.Mode()&os.ModeSymlink == 0 {
+		return nil
+	}
+	return os.Remove(localPath)
+}
+
+// write current tar entry to local file
+func writeTarFile(r io.Reader, localPath string, info os.FileInfo) error {
+	f, err := os.OpenFile(localPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	_, err = io.Copy(f, r)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// check p is inside any of dirs
+func hasPathPrefix(p string, dirs []string) bool {
+	for _, d := range dirs {
+		if strings.HasPrefix(p, d+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
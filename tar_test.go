@@ -0,0 +1,180 @@
+package sshutils
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// tar entry of the test stream
+type testTarEntry struct {
+	name     string
+	typ      byte
+	linkname string
+	body     string
+}
+
+func newTestTar(t *testing.T, entries []testTarEntry) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Typeflag: e.typ, Linkname: e.linkname, Mode: 0644, Size: int64(len(e.body))}
+		if e.typ == tar.TypeDir {
+			hdr.Mode = 0755
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+func TestReadTar(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []testTarEntry
+		// files in the destination dir after the extraction
+		want    map[string]string
+		wantErr string
+	}{
+		{
+			name: "files",
+			entries: []testTarEntry{
+				{name: "./", typ: tar.TypeDir},
+				{name: "./a", typ: tar.TypeReg, body: "a"},
+				{name: "./d/", typ: tar.TypeDir},
+				{name: "./d/b", typ: tar.TypeReg, body: "b"},
+			},
+			want: map[string]string{"a": "a", "d/b": "b"},
+		},
+		{
+			name:    "absolute path",
+			entries: []testTarEntry{{name: "/etc/evil", typ: tar.TypeReg, body: "x"}},
+			wantErr: "invalid path",
+		},
+		{
+			name:    "parent path",
+			entries: []testTarEntry{{name: "../evil", typ: tar.TypeReg, body: "x"}},
+			wantErr: "invalid path",
+		},
+		{
+			name:    "parent path after clean",
+			entries: []testTarEntry{{name: "d/../../evil", typ: tar.TypeReg, body: "x"}},
+			wantErr: "invalid path",
+		},
+		{
+			name:    "parent path only",
+			entries: []testTarEntry{{name: "..", typ: tar.TypeDir}},
+			wantErr: "invalid path",
+		},
+		{
+			name: "write through symlink dir",
+			entries: []testTarEntry{
+				{name: "link", typ: tar.TypeSymlink, linkname: "../outside"},
+				{name: "link/evil", typ: tar.TypeReg, body: "x"},
+			},
+			wantErr: "parent is a symlink",
+		},
+		{
+			name: "write through symlink file",
+			entries: []testTarEntry{
+				{name: "link", typ: tar.TypeSymlink, linkname: "../outside/evil"},
+				{name: "link", typ: tar.TypeReg, body: "x"},
+			},
+			want: map[string]string{"link": "x"},
+		},
+		{
+			name: "hard link",
+			entries: []testTarEntry{
+				{name: "a", typ: tar.TypeReg, body: "a"},
+				{name: "b", typ: tar.TypeLink, linkname: "a"},
+			},
+			want: map[string]string{"a": "a", "b": "a"},
+		},
+		{
+			name:    "hard link outside",
+			entries: []testTarEntry{{name: "b", typ: tar.TypeLink, linkname: "../outside/evil"}},
+			wantErr: "invalid link",
+		},
+		{
+			name: "hard link through symlink",
+			entries: []testTarEntry{
+				{name: "link", typ: tar.TypeSymlink, linkname: "../outside"},
+				{name: "b", typ: tar.TypeLink, linkname: "link/evil"},
+			},
+			wantErr: "parent is a symlink",
+		},
+		{
+			name: "hard link to symlink",
+			entries: []testTarEntry{
+				{name: "link", typ: tar.TypeSymlink, linkname: "../outside/evil"},
+				{name: "b", typ: tar.TypeLink, linkname: "link"},
+			},
+			wantErr: "invalid link",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root, err := ioutil.TempDir("", "sshutils-tar-")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() {
+				_ = os.RemoveAll(root)
+			}()
+			dst := filepath.Join(root, "dst")
+			outside := filepath.Join(root, "outside")
+			for _, dir := range []string{dst, outside} {
+				if err = os.Mkdir(dir, 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			evil := filepath.Join(outside, "evil")
+			if err = ioutil.WriteFile(evil, []byte("keep"), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			s := &scpClient{}
+			_, err = s.readTar(newTestTar(t, tt.entries), "/remote", dst)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("error %v, want %q", err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			if b, err := ioutil.ReadFile(evil); err != nil || string(b) != "keep" {
+				t.Errorf("file outside the destination changed: %q, %v", b, err)
+			}
+			if _, err = os.Lstat(filepath.Join(root, "evil")); err == nil {
+				t.Error("file created outside the destination")
+			}
+			for name, want := range tt.want {
+				p := filepath.Join(dst, filepath.FromSlash(name))
+				info, err := os.Lstat(p)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !info.Mode().IsRegular() {
+					t.Errorf("%s: mode %v", name, info.Mode())
+					continue
+				}
+				if b, _ := ioutil.ReadFile(p); string(b) != want {
+					t.Errorf("%s: content %q, want %q", name, b, want)
+				}
+			}
+		})
+	}
+}
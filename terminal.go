@@ -0,0 +1,154 @@
+package sshutils
+
+import (
+	"io"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// WindowSize is the size of a terminal
+type WindowSize struct {
+	// size in characters
+	Width  int
+	Height int
+	// size in pixels, 0 if unknown
+	WidthPixels  int
+	HeightPixels int
+}
+
+// TerminalIO is the local side of an interactive terminal, e.g. the
+// process terminal, a websocket or a TUI pane
+type TerminalIO struct {
+	// input of the remote shell, escape sequences are handled
+	In io.Reader
+	// output of the remote shell
+	Out io.Writer
+	// stderr of the remote shell, nil writes to Out
+	Err io.Writer
+	// window size changes, may be nil
+	Resize <-chan WindowSize
+	// suspend the local side for the escape sequence `~^Z`, nil if not supported
+	Suspend func()
+}
+
+// OSTerminal returns the TerminalIO of the process terminal, stdin is
+// switched to raw mode and SIGWINCH is watched until restore is called
+func OSTerminal() (tio *TerminalIO, restore func(), err error) {
+	fd := int(os.Stdin.Fd())
+	state, err := terminal.MakeRaw(fd)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	resize, stop := osResizeEvents(fd)
+	tio = &TerminalIO{
+		In:     os.Stdin,
+		Out:    os.Stdout,
+		Err:    os.Stderr,
+		Resize: resize,
+		Suspend: func() {
+			_ = terminal.Restore(fd, state)
+			_ = syscall.Kill(syscall.Getpid(), syscall.SIGTSTP)
+			// resumed
+			_, _ = terminal.MakeRaw(fd)
+		},
+	}
+	restore = func() {
+		stop()
+		_ = terminal.Restore(fd, state)
+	}
+	return tio, restore, nil
+}
+
+// send the window size of fd when SIGWINCH changed it, the channel is
+// closed by stop
+func osResizeEvents(fd int) (<-chan WindowSize, func()) {
+	// SIGWINCH is sent to the process when the window size of the terminal has changed.
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGWINCH)
+
+	resize := make(chan WindowSize, 1)
+	go func() {
+		defer close(resize)
+		termWidth, termHeight, _ := terminal.GetSize(fd)
+		for range sigs {
+			currTermWidth, currTermHeight, err := terminal.GetSize(fd)
+			// Terminal size has not changed, don's do anything.
+			if err != nil || (currTermHeight == termHeight && currTermWidth == termWidth) {
+				continue
+			}
+			termWidth, termHeight = currTermWidth, currTermHeight
+			widthPixels, heightPixels := terminalPixels(fd)
+			resize <- WindowSize{Width: termWidth, Height: termHeight, WidthPixels: widthPixels, HeightPixels: heightPixels}
+		}
+	}()
+
+	stop := func() {
+		signal.Stop(sigs)
+		close(sigs)
+	}
+	return resize, stop
+}
+
+// apply the window size changes to the remote pty until resize or done is closed
+func (s *SSHSession) watchResize(resize <-chan WindowSize, done <-chan struct{}) {
+	if resize == nil {
+		return
+	}
+	go func() {
+		for {
+			var size WindowSize
+			var ok bool
+			select {
+			case <-done:
+				return
+			case size, ok = <-resize:
+				if !ok {
+					return
+				}
+			}
+
+			// The client updated the size of the local PTY. This change needs to occur on the server side PTY as well.
+			err := windowChange(s.session, size)
+			if err != nil {
+				s.log().Warn("window change failed", "width", size.Width, "height", size.Height, "error", err)
+				continue
+			}
+			s.log().Debug("window change", "width", size.Width, "height", size.Height)
+		}
+	}()
+}
+
+// send window-change, unlike ssh.Session.WindowChange it sends the pixel size
+func windowChange(session *ssh.Session, size WindowSize) error {
+	req := struct {
+		Columns uint32
+		Rows    uint32
+		Width   uint32
+		Height  uint32
+	}{
+		Columns: uint32(size.Width),
+		Rows:    uint32(size.Height),
+		Width:   uint32(size.WidthPixels),
+		Height:  uint32(size.HeightPixels),
+	}
+	_, err := session.SendRequest("window-change", false, ssh.Marshal(&req))
+	return err
+}
+
+// lockedWriter serializes writes of concurrent writers
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (l *lockedWriter) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Write(p)
+}
@@ -0,0 +1,34 @@
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd
+// +build darwin dragonfly freebsd netbsd openbsd
+
+package sshutils
+
+import (
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/sys/unix"
+)
+
+const ioctlReadTermios = unix.TIOCGETA
+
+// bsd only terminal modes
+var (
+	osCcModes = map[uint8]int{
+		ssh.VDSUSP:  unix.VDSUSP,
+		ssh.VSTATUS: unix.VSTATUS,
+	}
+	osIflagModes = map[uint8]uint64{}
+	osLflagModes = map[uint8]uint64{}
+	osOflagModes = map[uint8]uint64{}
+)
+
+// the speed is stored in termios, 38400 if unknown
+func termiosSpeed(t *unix.Termios) (ispeed, ospeed uint32) {
+	ispeed, ospeed = uint32(t.Ispeed), uint32(t.Ospeed)
+	if ispeed == 0 {
+		ispeed = 38400
+	}
+	if ospeed == 0 {
+		ospeed = 38400
+	}
+	return ispeed, ospeed
+}
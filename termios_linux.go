@@ -0,0 +1,56 @@
+package sshutils
+
+import (
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/sys/unix"
+)
+
+const ioctlReadTermios = unix.TCGETS
+
+// linux only terminal modes
+var (
+	osCcModes = map[uint8]int{
+		ssh.VSWTCH: unix.VSWTC,
+	}
+	osIflagModes = map[uint8]uint64{
+		ssh.IUCLC: unix.IUCLC,
+		ptyIUTF8:  unix.IUTF8,
+	}
+	osLflagModes = map[uint8]uint64{
+		ssh.XCASE: unix.XCASE,
+	}
+	osOflagModes = map[uint8]uint64{
+		ssh.OLCUC: unix.OLCUC,
+	}
+)
+
+// baud rates of the CBAUD bits
+var baudRates = map[uint32]uint32{
+	unix.B50:     50,
+	unix.B75:     75,
+	unix.B110:    110,
+	unix.B134:    134,
+	unix.B150:    150,
+	unix.B200:    200,
+	unix.B300:    300,
+	unix.B600:    600,
+	unix.B1200:   1200,
+	unix.B1800:   1800,
+	unix.B2400:   2400,
+	unix.B4800:   4800,
+	unix.B9600:   9600,
+	unix.B19200:  19200,
+	unix.B38400:  38400,
+	unix.B57600:  57600,
+	unix.B115200: 115200,
+	unix.B230400: 230400,
+}
+
+// the speed is stored in the CBAUD bits of cflag, 38400 if unknown
+func termiosSpeed(t *unix.Termios) (ispeed, ospeed uint32) {
+	speed, ok := baudRates[uint32(t.Cflag)&unix.CBAUD]
+	if !ok {
+		speed = 38400
+	}
+	return speed, speed
+}
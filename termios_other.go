@@ -0,0 +1,16 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package sshutils
+
+import "golang.org/x/crypto/ssh"
+
+// terminal modes are not supported, the defaults are used
+func terminalModes(fd int) ssh.TerminalModes {
+	return nil
+}
+
+// pixel size is not supported
+func terminalPixels(fd int) (width, height int) {
+	return 0, 0
+}
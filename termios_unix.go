@@ -0,0 +1,129 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package sshutils
+
+import (
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/sys/unix"
+)
+
+// termios control characters by terminal mode opcode
+var ccModes = map[uint8]int{
+	ssh.VINTR:    unix.VINTR,
+	ssh.VQUIT:    unix.VQUIT,
+	ssh.VERASE:   unix.VERASE,
+	ssh.VKILL:    unix.VKILL,
+	ssh.VEOF:     unix.VEOF,
+	ssh.VEOL:     unix.VEOL,
+	ssh.VEOL2:    unix.VEOL2,
+	ssh.VSTART:   unix.VSTART,
+	ssh.VSTOP:    unix.VSTOP,
+	ssh.VSUSP:    unix.VSUSP,
+	ssh.VREPRINT: unix.VREPRINT,
+	ssh.VWERASE:  unix.VWERASE,
+	ssh.VLNEXT:   unix.VLNEXT,
+	ssh.VDISCARD: unix.VDISCARD,
+}
+
+// termios flags by terminal mode opcode
+var (
+	iflagModes = map[uint8]uint64{
+		ssh.IGNPAR:  unix.IGNPAR,
+		ssh.PARMRK:  unix.PARMRK,
+		ssh.INPCK:   unix.INPCK,
+		ssh.ISTRIP:  unix.ISTRIP,
+		ssh.INLCR:   unix.INLCR,
+		ssh.IGNCR:   unix.IGNCR,
+		ssh.ICRNL:   unix.ICRNL,
+		ssh.IXON:    unix.IXON,
+		ssh.IXANY:   unix.IXANY,
+		ssh.IXOFF:   unix.IXOFF,
+		ssh.IMAXBEL: unix.IMAXBEL,
+	}
+	lflagModes = map[uint8]uint64{
+		ssh.ISIG:    unix.ISIG,
+		ssh.ICANON:  unix.ICANON,
+		ssh.ECHO:    unix.ECHO,
+		ssh.ECHOE:   unix.ECHOE,
+		ssh.ECHOK:   unix.ECHOK,
+		ssh.ECHONL:  unix.ECHONL,
+		ssh.NOFLSH:  unix.NOFLSH,
+		ssh.TOSTOP:  unix.TOSTOP,
+		ssh.IEXTEN:  unix.IEXTEN,
+		ssh.ECHOCTL: unix.ECHOCTL,
+		ssh.ECHOKE:  unix.ECHOKE,
+		ssh.PENDIN:  unix.PENDIN,
+	}
+	oflagModes = map[uint8]uint64{
+		ssh.OPOST:  unix.OPOST,
+		ssh.ONLCR:  unix.ONLCR,
+		ssh.OCRNL:  unix.OCRNL,
+		ssh.ONOCR:  unix.ONOCR,
+		ssh.ONLRET: unix.ONLRET,
+	}
+	cflagModes = map[uint8]uint64{
+		ssh.PARENB: unix.PARENB,
+		ssh.PARODD: unix.PARODD,
+	}
+)
+
+// read the terminal modes of fd, nil if fd is not a terminal
+func terminalModes(fd int) ssh.TerminalModes {
+	t, err := unix.IoctlGetTermios(fd, ioctlReadTermios)
+	if err != nil {
+		return nil
+	}
+
+	modes := ssh.TerminalModes{}
+	for _, cc := range []map[uint8]int{ccModes, osCcModes} {
+		for op, i := range cc {
+			modes[op] = uint32(t.Cc[i])
+		}
+	}
+	flags := []struct {
+		flag  uint64
+		modes []map[uint8]uint64
+	}{
+		{uint64(t.Iflag), []map[uint8]uint64{iflagModes, osIflagModes}},
+		{uint64(t.Lflag), []map[uint8]uint64{lflagModes, osLflagModes}},
+		{uint64(t.Oflag), []map[uint8]uint64{oflagModes, osOflagModes}},
+		{uint64(t.Cflag), []map[uint8]uint64{cflagModes}},
+	}
+	for _, f := range flags {
+		for _, m := range f.modes {
+			for op, mask := range m {
+				modes[op] = flagValue(f.flag, mask)
+			}
+		}
+	}
+
+	csize := uint64(t.Cflag) & unix.CSIZE
+	modes[ssh.CS7] = boolValue(csize == unix.CS7)
+	modes[ssh.CS8] = boolValue(csize == unix.CS8)
+
+	ispeed, ospeed := termiosSpeed(t)
+	modes[ssh.TTY_OP_ISPEED] = ispeed
+	modes[ssh.TTY_OP_OSPEED] = ospeed
+	return modes
+}
+
+// read the window size in pixels of fd, 0 if unknown
+func terminalPixels(fd int) (width, height int) {
+	ws, err := unix.IoctlGetWinsize(fd, unix.TIOCGWINSZ)
+	if err != nil {
+		return 0, 0
+	}
+	return int(ws.Xpixel), int(ws.Ypixel)
+}
+
+func flagValue(flag, mask uint64) uint32 {
+	return boolValue(flag&mask != 0)
+}
+
+func boolValue(b bool) uint32 {
+	if b {
+		return 1
+	}
+	return 0
+}
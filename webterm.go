@@ -0,0 +1,320 @@
+package sshutils
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/crypto/ssh"
+)
+
+// ErrIdleTimeout means the web terminal was closed because the client was idle
+var ErrIdleTimeout = errors.New("idle timeout")
+
+// WebTerminal is an http.Handler which bridges a websocket to an interactive
+// shell, it is compatible with xterm.js
+//
+// The client sends input as binary messages or text messages of JSON:
+//
+//	{"type": "data", "data": "ls\r"}
+//	{"type": "resize", "cols": 80, "rows": 24}
+//	{"type": "ping"}
+//
+// The server sends output as binary messages, and replies `{"type": "pong"}`
+// and `{"type": "exit", "code": 0, "error": ""}` as text messages. The initial
+// size can be set by the `cols` and `rows` query parameters.
+type WebTerminal struct {
+	// returns the connection for the request, e.g. from a Pool
+	Client func(r *http.Request) (*ssh.Client, error)
+	// pty options, the size is overridden by the query parameters
+	PtyOptions *PtyOptions
+	// close the session if the client sends no input or resize in this
+	// duration, pings do not count; 0 disables it
+	IdleTimeout time.Duration
+	// opens the recording of the request in asciicast v2 format, nil disables recording
+	Recorder func(r *http.Request) (io.WriteCloser, error)
+	Upgrader websocket.Upgrader
+	Logger   Logger
+}
+
+// message of the web terminal protocol
+type webTermMessage struct {
+	Type string `json:"type"`
+	Data string `json:"data,omitempty"`
+	Cols int    `json:"cols,omitempty"`
+	Rows int    `json:"rows,omitempty"`
+}
+
+// exit message of the web terminal protocol
+type webTermExit struct {
+	Type  string `json:"type"`
+	Code  int    `json:"code"`
+	Error string `json:"error,omitempty"`
+}
+
+func (t *WebTerminal) log() Logger {
+	return loggerOrNop(t.Logger)
+}
+
+func (t *WebTerminal) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	client, err := t.Client(r)
+	if err != nil {
+		t.log().Error("web terminal client failed", "remote", r.RemoteAddr, "error", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	conn, err := t.Upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		t.log().Warn("websocket upgrade failed", "remote", r.RemoteAddr, "error", err)
+		return
+	}
+	ws := &webTermConn{conn: conn}
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	session, err := client.NewSession()
+	if err != nil {
+		ws.exit(err)
+		return
+	}
+	s := NewSSHSession(session)
+	defer func() {
+		_ = s.Close()
+	}()
+	s.SetLogger(t.Logger)
+	s.SetClient(client)
+	s.SetEscapeChar(NoEscape)
+
+	ptyOptions := t.PtyOptions.merge(DefaultPtyOptions(-1))
+	if cols, err := strconv.Atoi(r.URL.Query().Get("cols")); err == nil && cols > 0 {
+		ptyOptions.Width = cols
+	}
+	if rows, err := strconv.Atoi(r.URL.Query().Get("rows")); err == nil && rows > 0 {
+		ptyOptions.Height = rows
+	}
+	s.SetPtyOptions(ptyOptions)
+
+	var out io.Writer = ws
+	if t.Recorder != nil {
+		rw, err := t.Recorder(r)
+		if err != nil {
+			ws.exit(err)
+			return
+		}
+		rec := newAsciicastRecorder(rw, ptyOptions)
+		defer func() {
+			_ = rw.Close()
+		}()
+		ws.rec = rec
+		out = io.MultiWriter(ws, rec)
+	}
+
+	pr, pw := io.Pipe()
+	defer func() {
+		_ = pr.Close()
+	}()
+	resize := make(chan WindowSize, 1)
+	idle := make(chan struct{}, 1)
+	go ws.readLoop(pw, resize, idle, s.log())
+
+	// close the session if the client is idle or gone
+	doneCh := make(chan struct{})
+	defer close(doneCh)
+	idleTimeoutCh := make(chan struct{})
+	go func() {
+		var timeout <-chan time.Time
+		var timer *time.Timer
+		if t.IdleTimeout > 0 {
+			timer = time.NewTimer(t.IdleTimeout)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		for {
+			select {
+			case <-doneCh:
+				return
+			case _, ok := <-idle:
+				if !ok {
+					// client is gone
+					_ = session.Close()
+					return
+				}
+				if timer != nil {
+					if !timer.Stop() {
+						<-timer.C
+					}
+					timer.Reset(t.IdleTimeout)
+				}
+			case <-timeout:
+				s.log().Info("web terminal idle timeout", "remote", r.RemoteAddr, "timeout", t.IdleTimeout)
+				close(idleTimeoutCh)
+				_ = session.Close()
+				return
+			}
+		}
+	}()
+
+	t.log().Info("web terminal started", "remote", r.RemoteAddr)
+	err = s.TerminalWithIO(&TerminalIO{In: pr, Out: out, Resize: resize}, 0)
+	select {
+	case <-idleTimeoutCh:
+		err = ErrIdleTimeout
+	default:
+	}
+	t.log().Info("web terminal finished", "remote", r.RemoteAddr, "error", err)
+	ws.exit(err)
+}
+
+// webTermConn serializes writes to the websocket
+type webTermConn struct {
+	conn *websocket.Conn
+	mu   sync.Mutex
+	rec  *asciicastRecorder
+}
+
+// write output as binary message
+func (c *webTermConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	err := c.conn.WriteMessage(websocket.BinaryMessage, p)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *webTermConn) writeJSON(msg interface{}) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn.WriteJSON(msg)
+}
+
+// send the exit message and close the websocket
+func (c *webTermConn) exit(err error) {
+	msg := webTermExit{Type: "exit"}
+	if err != nil {
+		msg.Code = -1
+		msg.Error = err.Error()
+		var exitErr *ssh.ExitError
+		if errors.As(err, &exitErr) {
+			msg.Code = exitErr.ExitStatus()
+		}
+	}
+	_ = c.writeJSON(msg)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_ = c.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+}
+
+// read client messages until the websocket is closed, input is written to
+// pw, input and resize messages are signaled to idle which is closed when
+// the client is gone; pings keep the connection but not the session alive
+func (c *webTermConn) readLoop(pw *io.PipeWriter, resize chan WindowSize, idle chan struct{}, log Logger) {
+	defer close(idle)
+	defer func() {
+		_ = pw.Close()
+	}()
+
+	active := func() {
+		select {
+		case idle <- struct{}{}:
+		default:
+		}
+	}
+
+	for {
+		typ, data, err := c.conn.ReadMessage()
+		if err != nil {
+			log.Debug("websocket closed", "error", err)
+			return
+		}
+
+		if typ == websocket.BinaryMessage {
+			active()
+			if _, err = pw.Write(data); err != nil {
+				return
+			}
+			continue
+		}
+
+		var msg webTermMessage
+		if err = json.Unmarshal(data, &msg); err != nil {
+			log.Warn("bad web terminal message", "error", err)
+			continue
+		}
+		switch msg.Type {
+		case "data":
+			active()
+			if _, err = io.WriteString(pw, msg.Data); err != nil {
+				return
+			}
+		case "resize":
+			if msg.Cols <= 0 || msg.Rows <= 0 {
+				continue
+			}
+			active()
+			size := WindowSize{Width: msg.Cols, Height: msg.Rows}
+			// keep the latest size only
+			select {
+			case <-resize:
+			default:
+			}
+			resize <- size
+			if c.rec != nil {
+				c.rec.resize(size)
+			}
+		case "ping":
+			if err = c.writeJSON(webTermMessage{Type: "pong"}); err != nil {
+				return
+			}
+		default:
+			log.Warn("unknown web terminal message", "type", msg.Type)
+		}
+	}
+}
+
+// asciicastRecorder writes the output in asciicast v2 format
+type asciicastRecorder struct {
+	mu    sync.Mutex
+	w     io.Writer
+	start time.Time
+}
+
+func newAsciicastRecorder(w io.Writer, opts *PtyOptions) *asciicastRecorder {
+	rec := &asciicastRecorder{w: w, start: time.Now()}
+	header, _ := json.Marshal(map[string]interface{}{
+		"version":   2,
+		"width":     opts.Width,
+		"height":    opts.Height,
+		"timestamp": rec.start.Unix(),
+		"env":       map[string]string{"TERM": opts.Term},
+	})
+	_, _ = rec.w.Write(append(header, '\n'))
+	return rec
+}
+
+// write an event line
+func (rec *asciicastRecorder) event(code, data string) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	line, _ := json.Marshal([]interface{}{time.Since(rec.start).Seconds(), code, data})
+	_, _ = rec.w.Write(append(line, '\n'))
+}
+
+// record output, errors are ignored to not break the terminal
+func (rec *asciicastRecorder) Write(p []byte) (int, error) {
+	rec.event("o", string(p))
+	return len(p), nil
+}
+
+func (rec *asciicastRecorder) resize(size WindowSize) {
+	rec.event("r", strconv.Itoa(size.Width)+"x"+strconv.Itoa(size.Height))
+}